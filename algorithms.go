@@ -0,0 +1,173 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	wildcard "github.com/IGLOU-EU/go-wildcard/v2"
+	"golang.org/x/crypto/ssh"
+)
+
+// assembleAlgorithms returns the algorithms of v applied to defaults in the same manner as OpenSSH.
+// v is a comma separated list. If it starts with '+', the algorithms are appended to defaults.
+// If it starts with '-', the algorithms ( wildcards are allowed ) are removed from defaults. It is an error to remove all of them.
+// If it starts with '^', the algorithms are placed at the head of defaults.
+// Otherwise the algorithms replace defaults. If v is empty, nil is returned.
+func assembleAlgorithms(v string, defaults, supported []string) ([]string, error) {
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return nil, nil
+	}
+	switch v[0] {
+	case '+':
+		algos, err := expandAlgorithms(v[1:], supported)
+		if err != nil {
+			return nil, err
+		}
+		result := slices.Clone(defaults)
+		for _, a := range algos {
+			if !slices.Contains(result, a) {
+				result = append(result, a)
+			}
+		}
+		return result, nil
+	case '-':
+		patterns := splitList(v[1:])
+		result := slices.DeleteFunc(slices.Clone(defaults), func(a string) bool {
+			return slices.ContainsFunc(patterns, func(p string) bool {
+				return wildcard.Match(p, a)
+			})
+		})
+		if len(result) == 0 {
+			return nil, fmt.Errorf("no algorithm left after removing %q", v[1:])
+		}
+		return result, nil
+	case '^':
+		algos, err := expandAlgorithms(v[1:], supported)
+		if err != nil {
+			return nil, err
+		}
+		result := slices.Clone(algos)
+		for _, a := range defaults {
+			if !slices.Contains(result, a) {
+				result = append(result, a)
+			}
+		}
+		return result, nil
+	}
+	return expandAlgorithms(v, supported)
+}
+
+// joinAlgorithms returns algorithms as the value of ssh_config, validating it against defaults and supported.
+func joinAlgorithms(algorithms, defaults, supported []string) (string, error) {
+	v := strings.Join(algorithms, ",")
+	if strings.TrimSpace(v) == "" {
+		return "", errors.New("no algorithm specified")
+	}
+	if _, err := assembleAlgorithms(v, defaults, supported); err != nil {
+		return "", err
+	}
+	return v, nil
+}
+
+// expandAlgorithms returns the algorithms of the comma separated list with wildcards expanded.
+// If an algorithm is not in supported, an error is returned.
+func expandAlgorithms(v string, supported []string) ([]string, error) {
+	var algos []string
+	for _, p := range splitList(v) {
+		if !strings.ContainsAny(p, "*?") {
+			if !slices.Contains(supported, p) {
+				return nil, fmt.Errorf("unsupported algorithm %q", p)
+			}
+			if !slices.Contains(algos, p) {
+				algos = append(algos, p)
+			}
+			continue
+		}
+		for _, a := range supported {
+			if wildcard.Match(p, a) && !slices.Contains(algos, a) {
+				algos = append(algos, a)
+			}
+		}
+	}
+	if len(algos) == 0 {
+		return nil, fmt.Errorf("no supported algorithm in %q", v)
+	}
+	return algos, nil
+}
+
+// The default algorithms of the client of x/crypto/ssh, which the modifiers of ssh_config are applied to.
+var (
+	defaultCiphers = []string{
+		ssh.CipherAES128GCM,
+		ssh.CipherAES256GCM,
+		ssh.CipherChaCha20Poly1305,
+		ssh.CipherAES128CTR,
+		ssh.CipherAES192CTR,
+		ssh.CipherAES256CTR,
+	}
+	defaultMACs = []string{
+		ssh.HMACSHA256ETM,
+		ssh.HMACSHA512ETM,
+		ssh.HMACSHA256,
+		ssh.HMACSHA512,
+		ssh.HMACSHA1,
+		ssh.InsecureHMACSHA196,
+	}
+	defaultKexAlgorithms = []string{
+		ssh.KeyExchangeMLKEM768X25519,
+		ssh.KeyExchangeCurve25519,
+		ssh.KeyExchangeECDHP256,
+		ssh.KeyExchangeECDHP384,
+		ssh.KeyExchangeECDHP521,
+		ssh.KeyExchangeDH14SHA256,
+		ssh.InsecureKeyExchangeDH14SHA1,
+	}
+	defaultHostKeyAlgorithms = []string{
+		ssh.CertAlgoRSASHA256v01,
+		ssh.CertAlgoRSASHA512v01,
+		ssh.CertAlgoRSAv01,
+		ssh.InsecureCertAlgoDSAv01,
+		ssh.CertAlgoECDSA256v01,
+		ssh.CertAlgoECDSA384v01,
+		ssh.CertAlgoECDSA521v01,
+		ssh.CertAlgoED25519v01,
+		ssh.KeyAlgoECDSA256,
+		ssh.KeyAlgoECDSA384,
+		ssh.KeyAlgoECDSA521,
+		ssh.KeyAlgoRSASHA256,
+		ssh.KeyAlgoRSASHA512,
+		ssh.KeyAlgoRSA,
+		ssh.InsecureKeyAlgoDSA,
+		ssh.KeyAlgoED25519,
+	}
+)
+
+func supportedCiphers() []string {
+	return append(ssh.SupportedAlgorithms().Ciphers, ssh.InsecureAlgorithms().Ciphers...)
+}
+
+func supportedMACs() []string {
+	return append(ssh.SupportedAlgorithms().MACs, ssh.InsecureAlgorithms().MACs...)
+}
+
+func supportedKexAlgorithms() []string {
+	return append(ssh.SupportedAlgorithms().KeyExchanges, ssh.InsecureAlgorithms().KeyExchanges...)
+}
+
+func supportedHostKeyAlgorithms() []string {
+	return append(ssh.SupportedAlgorithms().HostKeys, ssh.InsecureAlgorithms().HostKeys...)
+}
+
+// algorithmsForKeyType returns the signature algorithms for the key type in order of preference.
+func algorithmsForKeyType(keyType string) []string {
+	switch keyType {
+	case ssh.KeyAlgoRSA:
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	case ssh.CertAlgoRSAv01:
+		return []string{ssh.CertAlgoRSASHA512v01, ssh.CertAlgoRSASHA256v01, ssh.CertAlgoRSAv01}
+	}
+	return []string{keyType}
+}
@@ -0,0 +1,110 @@
+package sshc
+
+import (
+	"slices"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestAssembleAlgorithms(t *testing.T) {
+	defaults := []string{"a", "b-1", "b-2", "c"}
+	supported := []string{"a", "b-1", "b-2", "c", "d", "e"}
+	tests := []struct {
+		in      string
+		want    []string
+		wantErr bool
+	}{
+		{"", nil, false},
+		{"c,a", []string{"c", "a"}, false},
+		{"b-*,a", []string{"b-1", "b-2", "a"}, false},
+		{"+d,a", []string{"a", "b-1", "b-2", "c", "d"}, false},
+		{"-b-*", []string{"a", "c"}, false},
+		{"-x", []string{"a", "b-1", "b-2", "c"}, false},
+		{"-*", nil, true},
+		{"-a,b-*,c", nil, true},
+		{"^e,c", []string{"e", "c", "a", "b-1", "b-2"}, false},
+		{"x", nil, true},
+		{"+x", nil, true},
+		{"^x", nil, true},
+		{"x*", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := assembleAlgorithms(tt.in, defaults, supported)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAlgorithms(t *testing.T) {
+	srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+		c.Ciphers = []string{ssh.CipherAES256CTR}
+		c.MACs = []string{ssh.HMACSHA512}
+		c.KeyExchanges = []string{ssh.KeyExchangeECDHP384}
+	}))
+	tests := []struct {
+		name    string
+		config  string
+		opts    []Option
+		wantErr bool
+	}{
+		{"defaults", "", nil, false},
+		{"Ciphers", "  Ciphers aes256-ctr\n", nil, false},
+		{"Ciphers without the one of server", "  Ciphers aes128-ctr,aes192-ctr\n", nil, true},
+		{"Ciphers with -", "  Ciphers -aes256-*\n", nil, true},
+		{"MACs without the one of server", "  MACs hmac-sha2-256\n", nil, true},
+		{"KexAlgorithms", "  KexAlgorithms ecdh-sha2-nistp384\n", nil, false},
+		{"KexAlgorithms without the one of server", "  KexAlgorithms curve25519-sha256\n", nil, true},
+		{"Ciphers option overrides ssh_config", "  Ciphers aes128-ctr\n", []Option{Ciphers("aes256-ctr")}, false},
+		{"KexAlgorithms option with +", "  KexAlgorithms curve25519-sha256\n", []Option{KexAlgorithms("+ecdh-sha2-nistp384")}, false},
+		{"MACs option", "", []Option{MACs("hmac-sha2-256")}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			opts := append(srv.optionsWithKey(t, tt.config), InsecureIgnoreHostKey())
+			opts = append(opts, tt.opts...)
+			client, err := NewClient("server", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+func TestAlgorithmsOption(t *testing.T) {
+	tests := []struct {
+		name    string
+		opt     Option
+		wantErr bool
+	}{
+		{"Ciphers", Ciphers("aes128-ctr", "aes256-ctr"), false},
+		{"Ciphers with +", Ciphers("+aes128-cbc"), false},
+		{"unsupported Ciphers", Ciphers("blowfish-cbc"), true},
+		{"empty Ciphers", Ciphers(), true},
+		{"Ciphers removing all", Ciphers("-*"), true},
+		{"MACs", MACs("hmac-sha2-*"), false},
+		{"unsupported MACs", MACs("umac-64@openssh.com"), true},
+		{"KexAlgorithms", KexAlgorithms("^curve25519-sha256"), false},
+		{"unsupported KexAlgorithms", KexAlgorithms("sntrup761x25519-sha512@openssh.com"), true},
+		{"HostKeyAlgorithms", HostKeyAlgorithms("-ssh-rsa"), false},
+		{"unsupported HostKeyAlgorithms", HostKeyAlgorithms("ssh-unknown"), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewConfig(ClearConfig(), tt.opt)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
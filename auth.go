@@ -0,0 +1,291 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sync"
+
+	"github.com/ScaleFT/sshkeys"
+	"golang.org/x/crypto/ssh"
+)
+
+// unsupportedKeyTypes are the types of the private keys that x/crypto/ssh cannot parse ( security keys and XMSS ).
+var unsupportedKeyTypes = []string{ssh.KeyAlgoSKECDSA256, ssh.KeyAlgoSKED25519, "ssh-xmss@openssh.com"}
+
+// lazySigner is ssh.Signer of an encrypted key whose passphrase is asked only when it is used for signing.
+type lazySigner struct {
+	pub  ssh.PublicKey
+	load func() (ssh.Signer, error)
+
+	once   sync.Once
+	loaded ssh.Signer
+	err    error
+}
+
+// signers returns the signers of KeyAndPassphrases in order.
+// If the public key of an encrypted key is known ( from the key itself or the .pub file next to it ), asking the passphrase is deferred until the key is used.
+// Keys that cannot be parsed are skipped as OpenSSH does. Encrypted keys that cannot be decrypted are also skipped, and the errors are returned as skipped.
+func (dc *DialConfig) signers(prompter Prompter) (signers []ssh.Signer, skipped error) {
+	var errs []error
+	for _, k := range dc.KeyAndPassphrases {
+		signer, err := sshkeys.ParseEncryptedPrivateKey(k.key, k.passphrase)
+		if err == nil {
+			signers = append(signers, signer)
+			continue
+		}
+		if !k.encrypted(err) {
+			// unsupported or broken key
+			continue
+		}
+		load := func() (ssh.Signer, error) {
+			// passphrase
+			passPhrase, err := prompter.PassphrasePrompt(k.path)
+			if err != nil {
+				return nil, err
+			}
+			return sshkeys.ParseEncryptedPrivateKey(k.key, passPhrase)
+		}
+		pub := k.publicKey(err)
+		if pub != nil && slices.Contains(unsupportedKeyTypes, pub.Type()) {
+			// the key cannot be used even if it is decrypted
+			continue
+		}
+		if pub != nil {
+			signers = append(signers, &lazySigner{pub: pub, load: load})
+			continue
+		}
+		signer, err = load()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	return signers, errors.Join(errs...)
+}
+
+// failedKeys returns the keys of the lazySigners in signers that failed to load.
+func failedKeys(signers []ssh.Signer) map[string]bool {
+	failed := map[string]bool{}
+	for _, s := range signers {
+		if ls, ok := s.(*lazySigner); ok && ls.err != nil {
+			failed[signerKey(ls)] = true
+		}
+	}
+	return failed
+}
+
+// withoutFailedKeys returns pubkeys without the keys ( and their certificates ) of the lazySigners in signers that failed to load.
+func withoutFailedKeys(pubkeys, signers []ssh.Signer) []ssh.Signer {
+	failed := failedKeys(signers)
+	var result []ssh.Signer
+	for _, s := range pubkeys {
+		if failed[signerKey(s)] {
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// hasKeysAfterFailure reports whether pubkeys has keys to try after the keys of the lazySigners that failed to load since failed was taken.
+func hasKeysAfterFailure(pubkeys, signers []ssh.Signer, failed map[string]bool) bool {
+	now := failedKeys(signers)
+	newly := false
+	for _, s := range pubkeys {
+		k := signerKey(s)
+		switch {
+		case now[k] && !failed[k]:
+			newly = true
+		case newly && !now[k]:
+			return true
+		}
+	}
+	return false
+}
+
+// signerKey returns the key of s, or the key certified if s is a certificate signer.
+func signerKey(s ssh.Signer) string {
+	pub := s.PublicKey()
+	if cert, ok := pub.(*ssh.Certificate); ok {
+		pub = cert.Key
+	}
+	return string(pub.Marshal())
+}
+
+// lazySignerErrors returns the errors of the lazySigners in signers that failed to load the keys.
+func lazySignerErrors(signers []ssh.Signer) error {
+	var errs []error
+	for _, s := range signers {
+		if ls, ok := s.(*lazySigner); ok && ls.err != nil {
+			errs = append(errs, ls.err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// certificates parses Certificates.
+func (dc *DialConfig) certificates() ([]*ssh.Certificate, error) {
+	var certs []*ssh.Certificate
+	for _, b := range dc.Certificates {
+		pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse certificate: %w", err)
+		}
+		cert, ok := pub.(*ssh.Certificate)
+		if !ok {
+			return nil, fmt.Errorf("not a certificate: %s", pub.Type())
+		}
+		certs = append(certs, cert)
+	}
+	return certs, nil
+}
+
+// identities returns the public keys of signers ( the keys of KeyAndPassphrases ) and certs.
+// For certificates, both the certificate and the key certified are returned.
+func (dc *DialConfig) identities(signers []ssh.Signer, certs []*ssh.Certificate) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for _, s := range signers {
+		keys = append(keys, s.PublicKey())
+	}
+	for _, cert := range certs {
+		keys = append(keys, cert, cert.Key)
+	}
+	return keys
+}
+
+// publicKeySigners returns the signers to offer in the same order as OpenSSH: keys of ssh-agent first, then keys of files not in ssh-agent.
+// If identitiesOnly is true, only the keys of ssh-agent in identities are offered.
+func publicKeySigners(agentSigners, fileSigners []ssh.Signer, identitiesOnly bool, identities []ssh.PublicKey) []ssh.Signer {
+	allowed := map[string]bool{}
+	for _, k := range identities {
+		allowed[string(k.Marshal())] = true
+	}
+	seen := map[string]bool{}
+	var signers []ssh.Signer
+	for _, s := range agentSigners {
+		k := string(s.PublicKey().Marshal())
+		if identitiesOnly && !allowed[k] {
+			continue
+		}
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		signers = append(signers, s)
+	}
+	for _, s := range fileSigners {
+		k := string(s.PublicKey().Marshal())
+		if seen[k] {
+			continue
+		}
+		seen[k] = true
+		signers = append(signers, s)
+	}
+	return signers
+}
+
+// withCertificates returns signers with the certificate signers inserted before the signers of the keys they certify.
+// Certificates already in signers ( e.g. held by ssh-agent ) are not duplicated.
+func withCertificates(signers []ssh.Signer, certs []*ssh.Certificate) ([]ssh.Signer, error) {
+	if len(certs) == 0 {
+		return signers, nil
+	}
+	seen := map[string]bool{}
+	for _, s := range signers {
+		seen[string(s.PublicKey().Marshal())] = true
+	}
+	var result []ssh.Signer
+	for _, s := range signers {
+		if _, ok := s.PublicKey().(*ssh.Certificate); !ok {
+			k := string(s.PublicKey().Marshal())
+			for _, cert := range certs {
+				c := string(cert.Marshal())
+				if seen[c] || string(cert.Key.Marshal()) != k {
+					continue
+				}
+				cs, err := ssh.NewCertSigner(cert, s)
+				if err != nil {
+					return nil, err
+				}
+				seen[c] = true
+				result = append(result, cs)
+			}
+		}
+		result = append(result, s)
+	}
+	return result, nil
+}
+
+// encrypted reports whether the key is encrypted, from the error of parsing it with the passphrase of KeyAndPassphrase.
+func (k KeyAndPassphrase) encrypted(parseErr error) bool {
+	var missing *ssh.PassphraseMissingError
+	if errors.As(parseErr, &missing) {
+		return true
+	}
+	if k.passphrase == nil {
+		return false
+	}
+	// the passphrase is wrong
+	_, err := ssh.ParseRawPrivateKey(k.key)
+	return errors.As(err, &missing)
+}
+
+// publicKey returns the public key of the encrypted key, or nil if it is unknown.
+func (k KeyAndPassphrase) publicKey(parseErr error) ssh.PublicKey {
+	var missing *ssh.PassphraseMissingError
+	if errors.As(parseErr, &missing) && missing.PublicKey != nil {
+		return missing.PublicKey
+	}
+	if k.path == "" {
+		return nil
+	}
+	b, err := os.ReadFile(k.path + ".pub")
+	if err != nil {
+		return nil
+	}
+	pub, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		return nil
+	}
+	return pub
+}
+
+func (s *lazySigner) PublicKey() ssh.PublicKey {
+	return s.pub
+}
+
+func (s *lazySigner) Sign(rand io.Reader, data []byte) (*ssh.Signature, error) {
+	return s.SignWithAlgorithm(rand, data, "")
+}
+
+func (s *lazySigner) SignWithAlgorithm(rand io.Reader, data []byte, algorithm string) (*ssh.Signature, error) {
+	signer, err := s.signer()
+	if err != nil {
+		return nil, err
+	}
+	if as, ok := signer.(ssh.AlgorithmSigner); ok {
+		return as.SignWithAlgorithm(rand, data, algorithm)
+	}
+	if algorithm != "" && algorithm != s.pub.Type() {
+		return nil, fmt.Errorf("unsupported signature algorithm %s", algorithm)
+	}
+	return signer.Sign(rand, data)
+}
+
+func (s *lazySigner) Algorithms() []string {
+	return algorithmsForKeyType(s.pub.Type())
+}
+
+func (s *lazySigner) signer() (ssh.Signer, error) {
+	s.once.Do(func() {
+		s.loaded, s.err = s.load()
+		if s.err == nil && string(s.loaded.PublicKey().Marshal()) != string(s.pub.Marshal()) {
+			s.loaded, s.err = nil, errors.New("private key does not match the public key")
+		}
+	})
+	return s.loaded, s.err
+}
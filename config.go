@@ -4,7 +4,9 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/sha256"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
 	"path/filepath"
@@ -18,15 +20,36 @@ import (
 	"golang.org/x/crypto/ssh"
 )
 
-const hostAny = "*"
+const (
+	hostAny = "*"
+
+	// maxIncludeDepth is the maximum nesting depth of Include (same as OpenSSH).
+	maxIncludeDepth = 16
+	// includeKey is the keyword that replaces Include while parsing ssh_config.
+	includeKey = "SshcInclude"
+)
 
 var (
 	defaultConfigPaths = []string{
 		filepath.Join("~", ".ssh", "config"),
 		filepath.Join("/", "etc", "ssh", "ssh_config"),
 	}
-	includeRelRe  = regexp.MustCompile(`^(Include\s+~)(.+)$`)
-	includeRelRe2 = regexp.MustCompile(`^(Include\s+)([^~/].+)$`)
+	// defaultIdentityFiles are the identity files tried when IdentityFile is not set (same as OpenSSH).
+	defaultIdentityFiles = []string{
+		filepath.Join("~", ".ssh", "id_rsa"),
+		filepath.Join("~", ".ssh", "id_ecdsa"),
+		filepath.Join("~", ".ssh", "id_ecdsa_sk"),
+		filepath.Join("~", ".ssh", "id_ed25519"),
+		filepath.Join("~", ".ssh", "id_ed25519_sk"),
+		filepath.Join("~", ".ssh", "id_xmss"),
+		filepath.Join("~", ".ssh", "id_dsa"),
+	}
+	// defaultValues override the defaults of kevinburke/ssh_config that differ from recent OpenSSH.
+	defaultValues = map[string]string{
+		// OpenSSH 8.5 and later
+		"checkhostip": "no",
+	}
+	keywordRe = regexp.MustCompile(`^\s*([A-Za-z]+)(?:\s*=\s*|\s+)(.*)$`)
 )
 
 type sshConfig struct {
@@ -41,6 +64,16 @@ type config struct {
 
 type configs []config
 
+type certificate struct {
+	pattern string
+	cert    []byte
+}
+
+type hostCertAuthority struct {
+	pattern string
+	key     ssh.PublicKey
+}
+
 type identityKey struct {
 	pattern    string
 	key        []byte
@@ -55,19 +88,39 @@ type identityFile struct {
 
 // Config is the type for the SSH Client config. not ssh_config.
 type Config struct {
-	configs         configs
-	hostname        string
-	user            string
-	port            int
-	identityFiles   []identityFile
-	identityKeys    []identityKey
-	passphrase      []byte
-	useAgent        bool
-	sshConfigs      []*sshConfig
-	knownhosts      []string
-	password        string
-	auth            []ssh.AuthMethod
-	dialTimeoutFunc func(network, addr string, timeout time.Duration) (net.Conn, error)
+	configs            configs
+	hostname           string
+	user               string
+	port               int
+	identityFiles      []identityFile
+	identityKeys       []identityKey
+	certificates       []certificate
+	defaultIdentity    []string
+	passphrase         []byte
+	useAgent           bool
+	sshConfigs         []*sshConfig
+	knownhosts         []string
+	strictHostKey      string
+	insecureHostKey    bool
+	hostCAs            []hostCertAuthority
+	ciphers            string
+	macs               string
+	kexAlgorithms      string
+	hostKeyAlgorithms  string
+	password           string
+	auth               []ssh.AuthMethod
+	prompter           Prompter
+	kbdInteractive     ssh.KeyboardInteractiveChallenge
+	dialTimeoutFunc    func(network, addr string, timeout time.Duration) (net.Conn, error)
+	connectTimeout     time.Duration
+	connectionAttempts int
+	proxyTimeout       time.Duration
+	proxyStderr        io.Writer
+	useForwards        bool
+
+	matches     []*match
+	includes    [][]*sshConfig
+	evaluations *evaluations
 }
 
 // Option is the type for change Config.
@@ -77,7 +130,9 @@ type Option func(*Config) error
 func NewConfig(options ...Option) (*Config, error) {
 	var err error
 	c := &Config{
-		useAgent: true, // Default is true
+		useAgent:        true, // Default is true
+		defaultIdentity: defaultIdentityFiles,
+		evaluations:     newEvaluations(),
 	}
 	base, err := os.Getwd()
 	if err != nil {
@@ -112,28 +167,11 @@ func NewConfig(options ...Option) (*Config, error) {
 		return nil, err
 	}
 	for _, cc := range c.configs {
-		buf := new(bytes.Buffer)
-		s := bufio.NewScanner(bytes.NewReader(cc.content))
-		for s.Scan() {
-			line := s.Bytes()
-
-			// Replace include path
-			if includeRelRe.Match(line) {
-				line = includeRelRe.ReplaceAll(line, []byte(fmt.Sprintf("Include %s$2", homeDir)))
-			} else if includeRelRe2.Match(line) {
-				line = includeRelRe2.ReplaceAll(line, []byte(fmt.Sprintf("Include %s/.ssh/$2", homeDir)))
-			}
-
-			if _, err := buf.Write(append(line, []byte("\n")...)); err != nil {
-				return nil, err
-			}
-		}
-
-		cfg, err := ssh_config.Decode(buf)
+		sc, err := c.parseConfig(cc.path, cc.content, homeDir, 0)
 		if err != nil {
 			return nil, err
 		}
-		c.sshConfigs = append([]*sshConfig{{path: cc.path, sc: cfg}}, c.sshConfigs...)
+		c.sshConfigs = append([]*sshConfig{sc}, c.sshConfigs...)
 	}
 
 	return c, nil
@@ -162,25 +200,35 @@ func (c *Config) Get(host, key string) string {
 }
 
 func (c *Config) getRaw(host, key string) string {
-	for _, scs := range c.sshConfigs {
-		val, err := scs.sc.Get(host, key)
-		if err != nil || val != "" {
-			return val
-		}
-	}
-	return ssh_config.Default(key)
+	val, _ := c.getRawWithBase(host, key)
+	return val
 }
 
 func (c *Config) getRawWithBase(host, key string) (string, string) {
-	for _, scs := range c.sshConfigs {
-		val, err := scs.sc.Get(host, key)
-		if err != nil || val != "" {
-			return val, filepath.Dir(scs.path)
-		}
+	if val, base, ok := c.lookupRaw(host, key); ok {
+		return val, base
+	}
+	if v, ok := defaultValues[strings.ToLower(key)]; ok {
+		return v, ""
 	}
 	return ssh_config.Default(key), ""
 }
 
+// lookupRaw returns the first value of key for host and the directory of the ssh_config that defines it.
+// It does not fall back to the default value.
+func (c *Config) lookupRaw(host, key string) (string, string, bool) {
+	vals := c.evaluate(host).values[strings.ToLower(key)]
+	if len(vals) == 0 {
+		return "", "", false
+	}
+	return vals[0].val, vals[0].base, true
+}
+
+// getRawAll returns all values of key for host across every ssh_config.
+func (c *Config) getRawAll(host, key string) []rawValue {
+	return c.evaluate(host).values[strings.ToLower(key)]
+}
+
 func (c *Config) getUser(host string) string {
 	if c.user != "" {
 		return c.user
@@ -204,10 +252,15 @@ func (c *Config) getHostname(host string) (string, error) {
 	if h == "" {
 		return host, nil
 	}
+	t := &tokens{hostname: host}
+	h, err := t.expand(h, hostnameTokens, false)
+	if err != nil {
+		return "", c.valueError(host, "Hostname", err)
+	}
 	return h, nil
 }
 
-func (c *Config) getKeyAndPassphrases(host string) ([]KeyAndPassphrase, error) {
+func (c *Config) getKeyAndPassphrases(host string, identityFiles []string) ([]KeyAndPassphrase, error) {
 	keys := []KeyAndPassphrase{}
 	if len(c.identityKeys) > 0 {
 		for _, i := range c.identityKeys {
@@ -233,43 +286,86 @@ func (c *Config) getKeyAndPassphrases(host string) ([]KeyAndPassphrase, error) {
 		}
 	}
 
-	user := c.getUser(host)
-	port, err := c.getPort(host)
-	if err != nil {
-		return nil, err
-	}
-	hostname, err := c.getHostname(host)
-	if err != nil {
-		return nil, err
+	for _, keyPath := range identityFiles {
+		if _, err := os.Lstat(keyPath); err != nil {
+			continue
+		}
+		b, err := os.ReadFile(keyPath)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, KeyAndPassphrase{
+			key:        b,
+			passphrase: c.passphrase,
+			path:       keyPath,
+		})
 	}
+	return keys, nil
+}
 
-	keyPath, base := c.getRawWithBase(host, "IdentityFile")
-	keyPath = expandVerbs(keyPath, user, port, hostname)
-	keyPath, err = expandPath(keyPath, base)
-	if err != nil {
-		return nil, err
+// getCertificates returns the certificates of Config.certificates, certificateFiles and the -cert.pub files next to the key files in keys.
+func (c *Config) getCertificates(host string, certificateFiles []string, keys []KeyAndPassphrase) ([][]byte, error) {
+	var certs [][]byte
+	for _, i := range c.certificates {
+		if wildcard.Match(i.pattern, host) {
+			certs = append(certs, i.cert)
+		}
 	}
-	if i, _ := expandPath("~/.ssh/identity", base); keyPath == i {
-		if _, err := os.Lstat(i); err != nil {
-			keyPath, err = expandPath("~/.ssh/id_rsa", base)
-			if err != nil {
-				return nil, err
-			}
+	files := append([]string{}, certificateFiles...)
+	for _, k := range keys {
+		if k.path != "" {
+			files = append(files, k.path+"-cert.pub")
 		}
 	}
-	if _, err := os.Lstat(keyPath); err != nil {
-		return keys, nil
+	for _, p := range files {
+		if _, err := os.Lstat(p); err != nil {
+			continue
+		}
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, b)
 	}
-	b, err := os.ReadFile(keyPath)
-	if err != nil {
-		return nil, err
+	return certs, nil
+}
+
+func (c *Config) getHostCertAuthorities(host string) []ssh.PublicKey {
+	var keys []ssh.PublicKey
+	for _, ca := range c.hostCAs {
+		if wildcard.Match(ca.pattern, host) {
+			keys = append(keys, ca.key)
+		}
 	}
-	keys = append(keys, KeyAndPassphrase{
-		key:        b,
-		passphrase: c.passphrase,
-		path:       keyPath,
-	})
-	return keys, nil
+	return keys
+}
+
+// getIdentityFiles returns all IdentityFile values of matching blocks in order with tokens and paths expanded.
+func (c *Config) getIdentityFiles(host string, t *tokens) ([]string, error) {
+	vals := c.getRawAll(host, "IdentityFile")
+	if len(vals) == 0 {
+		// missing default identity files are skipped when loading keys
+		base, err := os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range c.defaultIdentity {
+			vals = append(vals, rawValue{val: f, base: base})
+		}
+	}
+	var keyPaths []string
+	for _, v := range vals {
+		f, err := t.expand(v.val, fileTokens, true)
+		if err != nil {
+			return nil, c.valueError(host, "IdentityFile", err)
+		}
+		keyPath, err := expandPath(f, v.base)
+		if err != nil {
+			return nil, err
+		}
+		keyPaths = append(keyPaths, keyPath)
+	}
+	return keyPaths, nil
 }
 
 func (c *Config) getProxyCommand(host string) (string, string) {
@@ -360,6 +456,31 @@ func IdentityKeyWithPassphrase(b, passphrase []byte, hostPatterns ...string) Opt
 	}
 }
 
+// Certificate returns Option that append to Config.certificates for SSH client certificate ( authorized_keys format ).
+func Certificate(b []byte, hostPatterns ...string) Option {
+	return func(c *Config) error {
+		if len(hostPatterns) == 0 {
+			hostPatterns = []string{hostAny}
+		}
+		for _, pattern := range hostPatterns {
+			c.certificates = append(c.certificates, certificate{
+				pattern: pattern,
+				cert:    b,
+			})
+		}
+		return nil
+	}
+}
+
+// DefaultIdentityFiles returns Option that override the identity files tried when IdentityFile of ssh_config is not set.
+// Default is ~/.ssh/id_rsa, ~/.ssh/id_ecdsa, ~/.ssh/id_ecdsa_sk, ~/.ssh/id_ed25519, ~/.ssh/id_ed25519_sk, ~/.ssh/id_xmss and ~/.ssh/id_dsa.
+func DefaultIdentityFiles(files ...string) Option {
+	return func(c *Config) error {
+		c.defaultIdentity = append([]string{}, files...)
+		return nil
+	}
+}
+
 // Passphrase returns Option that set Config.passphrase for set SSH key passphrase.
 func Passphrase(p []byte) Option {
 	return func(c *Config) error {
@@ -376,6 +497,51 @@ func DialTimeoutFunc(fn func(network, addr string, timeout time.Duration) (net.C
 	}
 }
 
+// ConnectTimeout returns Option that override ConnectTimeout of ssh_config.
+// The timeout applies to the TCP dial and the SSH key exchange.
+func ConnectTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		if d <= 0 {
+			return fmt.Errorf("ConnectTimeout must be greater than 0, got %v", d)
+		}
+		c.connectTimeout = d
+		return nil
+	}
+}
+
+// ConnectionAttempts returns Option that override ConnectionAttempts of ssh_config.
+// The TCP dial is retried with backoff until it succeeds or n tries fail.
+func ConnectionAttempts(n int) Option {
+	return func(c *Config) error {
+		if n <= 0 {
+			return fmt.Errorf("ConnectionAttempts must be greater than 0, got %d", n)
+		}
+		c.connectionAttempts = n
+		return nil
+	}
+}
+
+// ProxyCommandTimeout returns Option that set the timeout of the SSH key exchange through ProxyCommand.
+// If it is not set, ConnectTimeout is used, or 30 seconds if ConnectTimeout is also not set.
+func ProxyCommandTimeout(d time.Duration) Option {
+	return func(c *Config) error {
+		if d <= 0 {
+			return fmt.Errorf("ProxyCommandTimeout must be greater than 0, got %v", d)
+		}
+		c.proxyTimeout = d
+		return nil
+	}
+}
+
+// ProxyCommandStderr returns Option that set the writer of the standard error output of ProxyCommand ( default is os.Stderr ).
+// Use io.Discard to drop it, or the writer of a logger ( e.g. log.Writer() ) to log it.
+func ProxyCommandStderr(w io.Writer) Option {
+	return func(c *Config) error {
+		c.proxyStderr = w
+		return nil
+	}
+}
+
 // ConfigData returns Option that unshift ssh_config data to Config.configs (alias of UnshiftConfigPath).
 func ConfigData(b []byte) Option {
 	return UnshiftConfigData(b)
@@ -390,7 +556,7 @@ func UnshiftConfigData(b []byte) Option {
 		}
 		r := sha256.Sum256(b)
 		c.configs = unshiftConfig(c.configs, config{
-			path:    filepath.Join(wd, string(r[:])),
+			path:    filepath.Join(wd, fmt.Sprintf("%x", r)),
 			content: b,
 		})
 		return nil
@@ -406,7 +572,7 @@ func AppendConfigData(b []byte) Option {
 		}
 		r := sha256.Sum256(b)
 		c.configs = appendConfig(c.configs, config{
-			path:    filepath.Join(wd, string(r[:])),
+			path:    filepath.Join(wd, fmt.Sprintf("%x", r)),
 			content: b,
 		})
 		return nil
@@ -480,6 +646,15 @@ func UseAgent(u bool) Option {
 	}
 }
 
+// UseForwards returns Option that start the LocalForward, RemoteForward and DynamicForward of ssh_config when the client is created by NewClient.
+// The forwardings stop when the client is closed. If ExitOnForwardFailure is set, NewClient fails when a forwarding cannot be started.
+func UseForwards(u bool) Option {
+	return func(c *Config) error {
+		c.useForwards = u
+		return nil
+	}
+}
+
 // Knownhosts returns Option that override Config.knownhosts.
 func Knownhosts(files ...string) Option {
 	return func(c *Config) error {
@@ -488,6 +663,99 @@ func Knownhosts(files ...string) Option {
 	}
 }
 
+// StrictHostKeyChecking returns Option that override StrictHostKeyChecking of ssh_config ( yes, no, ask or accept-new ).
+func StrictHostKeyChecking(v string) Option {
+	return func(c *Config) error {
+		v, err := parseStrictHostKeyChecking(v)
+		if err != nil {
+			return err
+		}
+		c.strictHostKey = v
+		return nil
+	}
+}
+
+// InsecureIgnoreHostKey returns Option that disable host key verification.
+func InsecureIgnoreHostKey() Option {
+	return func(c *Config) error {
+		c.insecureHostKey = true
+		return nil
+	}
+}
+
+// HostCertAuthority returns Option that trust the CA public key ( authorized_keys format ) to sign host certificates,
+// like a @cert-authority line of known_hosts.
+func HostCertAuthority(b []byte, hostPatterns ...string) Option {
+	return func(c *Config) error {
+		key, _, _, _, err := ssh.ParseAuthorizedKey(b)
+		if err != nil {
+			return err
+		}
+		if len(hostPatterns) == 0 {
+			hostPatterns = []string{hostAny}
+		}
+		for _, pattern := range hostPatterns {
+			c.hostCAs = append(c.hostCAs, hostCertAuthority{
+				pattern: pattern,
+				key:     key,
+			})
+		}
+		return nil
+	}
+}
+
+// Ciphers returns Option that override Ciphers of ssh_config.
+// As in ssh_config, the first algorithm can be prefixed with '+', '-' or '^' to modify the defaults.
+func Ciphers(algorithms ...string) Option {
+	return func(c *Config) error {
+		v, err := joinAlgorithms(algorithms, defaultCiphers, supportedCiphers())
+		if err != nil {
+			return err
+		}
+		c.ciphers = v
+		return nil
+	}
+}
+
+// MACs returns Option that override MACs of ssh_config.
+// As in ssh_config, the first algorithm can be prefixed with '+', '-' or '^' to modify the defaults.
+func MACs(algorithms ...string) Option {
+	return func(c *Config) error {
+		v, err := joinAlgorithms(algorithms, defaultMACs, supportedMACs())
+		if err != nil {
+			return err
+		}
+		c.macs = v
+		return nil
+	}
+}
+
+// KexAlgorithms returns Option that override KexAlgorithms of ssh_config.
+// As in ssh_config, the first algorithm can be prefixed with '+', '-' or '^' to modify the defaults.
+func KexAlgorithms(algorithms ...string) Option {
+	return func(c *Config) error {
+		v, err := joinAlgorithms(algorithms, defaultKexAlgorithms, supportedKexAlgorithms())
+		if err != nil {
+			return err
+		}
+		c.kexAlgorithms = v
+		return nil
+	}
+}
+
+// HostKeyAlgorithms returns Option that override HostKeyAlgorithms of ssh_config.
+// As in ssh_config, the first algorithm can be prefixed with '+', '-' or '^' to modify the defaults.
+func HostKeyAlgorithms(algorithms ...string) Option {
+	return func(c *Config) error {
+		v, err := joinAlgorithms(algorithms, defaultHostKeyAlgorithms, supportedHostKeyAlgorithms())
+		if err != nil {
+			return err
+		}
+		c.hostKeyAlgorithms = v
+		return nil
+	}
+}
+
 // Password returns Option that override Config.password.
 func Password(pass string) Option {
 	return func(c *Config) error {
@@ -504,6 +772,115 @@ func AuthMethod(m ssh.AuthMethod) Option {
 	}
 }
 
+// UsePrompter returns Option that set Prompter to ask for passphrases, passwords and unknown host keys.
+// If BatchMode of ssh_config is yes, NonInteractivePrompter is used instead.
+func UsePrompter(p Prompter) Option {
+	return func(c *Config) error {
+		c.prompter = p
+		return nil
+	}
+}
+
+// KeyboardInteractive returns Option that set the responder to the challenges of keyboard-interactive authentication.
+// It is used when KbdInteractiveAuthentication of ssh_config is yes ( default ).
+// If neither it nor UsePrompter is set, the challenges are asked on the terminal unless BatchMode is yes.
+func KeyboardInteractive(fn ssh.KeyboardInteractiveChallenge) Option {
+	return func(c *Config) error {
+		c.kbdInteractive = fn
+		return nil
+	}
+}
+
+// KeyboardInteractiveAnswers returns Option that answer the questions of keyboard-interactive authentication with answers in order.
+// The same answers are used for every challenge.
+func KeyboardInteractiveAnswers(answers ...string) Option {
+	return func(c *Config) error {
+		c.kbdInteractive = staticAnswers(answers)
+		return nil
+	}
+}
+
+// parseConfig decodes ssh_config content.
+// Match and Include are replaced with keywords that kevinburke/ssh_config can decode, and evaluated by Config itself.
+func (c *Config) parseConfig(path string, content []byte, homeDir string, depth int) (*sshConfig, error) {
+	if depth > maxIncludeDepth {
+		return nil, &ConfigParseError{File: path, Err: errors.New("too many nested Include")}
+	}
+	buf := new(bytes.Buffer)
+	s := bufio.NewScanner(bytes.NewReader(content))
+	n := 0
+	for s.Scan() {
+		n++
+		line := s.Text()
+		if m := keywordRe.FindStringSubmatch(line); m != nil {
+			switch strings.ToLower(m[1]) {
+			case "match":
+				mt, err := parseMatch(m[2])
+				if err != nil {
+					return nil, &ConfigParseError{File: path, Line: n, Err: err}
+				}
+				c.matches = append(c.matches, mt)
+				line = fmt.Sprintf("Host %s%d", matchHostPrefix, len(c.matches)-1)
+			case "include":
+				var included []*sshConfig
+				paths, err := includePaths(m[2], homeDir)
+				if err != nil {
+					return nil, &ConfigParseError{File: path, Line: n, Err: err}
+				}
+				for _, p := range paths {
+					b, err := os.ReadFile(p)
+					if err != nil {
+						return nil, err
+					}
+					sc, err := c.parseConfig(p, b, homeDir, depth+1)
+					if err != nil {
+						return nil, err
+					}
+					included = append(included, sc)
+				}
+				c.includes = append(c.includes, included)
+				line = fmt.Sprintf("%s %d", includeKey, len(c.includes)-1)
+			}
+		}
+		if _, err := buf.WriteString(line + "\n"); err != nil {
+			return nil, err
+		}
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+
+	cfg, err := ssh_config.Decode(buf)
+	if err != nil {
+		return nil, decodeError(err, path)
+	}
+	return &sshConfig{path: path, sc: cfg}, nil
+}
+
+// includePaths returns the file paths of Include arguments.
+// Relative paths are resolved from ~/.ssh.
+func includePaths(arg, homeDir string) ([]string, error) {
+	args, err := splitArgs(arg)
+	if err != nil {
+		return nil, err
+	}
+	var paths []string
+	for _, a := range args {
+		switch {
+		case strings.HasPrefix(a, "~"):
+			a = filepath.Join(homeDir, a[1:])
+		case !filepath.IsAbs(a):
+			a = filepath.Join(homeDir, ".ssh", a)
+		}
+		matches, err := filepath.Glob(a)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
 func appendConfig(cs configs, c config) configs {
 	return uniqueConfig(append(cs, c))
 }
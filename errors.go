@@ -0,0 +1,145 @@
+package sshc
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+var (
+	authFailedRe     = regexp.MustCompile(`unable to authenticate, attempted methods \[([^\]]*)\]`)
+	decodePositionRe = regexp.MustCompile(`^\((\d+), \d+\): (.*)$`)
+)
+
+// ConfigParseError is the error for an invalid ssh_config.
+type ConfigParseError struct {
+	// File is the path of the ssh_config.
+	File string
+	// Line is the line number in File ( 1-indexed ).
+	Line int
+	Err  error
+}
+
+func (e *ConfigParseError) Error() string {
+	return fmt.Sprintf("%s:%d: %v", e.File, e.Line, e.Err)
+}
+
+func (e *ConfigParseError) Unwrap() error {
+	return e.Err
+}
+
+// HostKeyMismatchError is the error returned when the host key presented by the server
+// does not match the host keys recorded in known_hosts.
+type HostKeyMismatchError struct {
+	// Hostname is the host name (host:port) looked up in known_hosts.
+	Hostname string
+	// Key is the host key presented by the server.
+	Key ssh.PublicKey
+	// Want is the host keys recorded in known_hosts.
+	Want []knownhosts.KnownKey
+	// ActualFingerprint is the SHA256 fingerprint of Key.
+	ActualFingerprint string
+	// ExpectedFingerprints are the SHA256 fingerprints of Want.
+	ExpectedFingerprints []string
+	// KnownHostsFile and KnownHostsLine are the location of the first host key in Want.
+	KnownHostsFile string
+	KnownHostsLine int
+	Err            error
+}
+
+func newHostKeyMismatchError(hostname string, key ssh.PublicKey, keyErr *knownhosts.KeyError) *HostKeyMismatchError {
+	e := &HostKeyMismatchError{
+		Hostname:          hostname,
+		Key:               key,
+		Want:              keyErr.Want,
+		ActualFingerprint: ssh.FingerprintSHA256(key),
+		Err:               keyErr,
+	}
+	for _, w := range keyErr.Want {
+		e.ExpectedFingerprints = append(e.ExpectedFingerprints, ssh.FingerprintSHA256(w.Key))
+	}
+	if len(keyErr.Want) > 0 {
+		e.KnownHostsFile = keyErr.Want[0].Filename
+		e.KnownHostsLine = keyErr.Want[0].Line
+	}
+	return e
+}
+
+func (e *HostKeyMismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s: got %s, want %s (%s:%d)", e.Hostname, e.ActualFingerprint, strings.Join(e.ExpectedFingerprints, ", "), e.KnownHostsFile, e.KnownHostsLine)
+}
+
+func (e *HostKeyMismatchError) Unwrap() error {
+	return e.Err
+}
+
+// AuthFailedError is the error returned when the server rejects all authentication methods.
+type AuthFailedError struct {
+	User string
+	// Addr is the address (host:port) of the server.
+	Addr string
+	// Methods are the authentication methods attempted.
+	Methods []string
+	Err     error
+}
+
+func (e *AuthFailedError) Error() string {
+	return fmt.Sprintf("authentication failed for %s@%s (attempted methods: %s): %v", e.User, e.Addr, strings.Join(e.Methods, ","), e.Err)
+}
+
+func (e *AuthFailedError) Unwrap() error {
+	return e.Err
+}
+
+// ProxyCommandError is the error returned when ProxyCommand fails.
+type ProxyCommandError struct {
+	Command string
+	// ExitCode is the exit code of ProxyCommand. It is -1 if the process was not started, still running or terminated by a signal.
+	ExitCode int
+	// Stderr is the tail of the standard error output of ProxyCommand.
+	Stderr []byte
+	Err    error
+}
+
+func (e *ProxyCommandError) Error() string {
+	msg := fmt.Sprintf("proxy command:%s error:%v", e.Command, e.Err)
+	if e.ExitCode >= 0 {
+		msg += fmt.Sprintf(" exit status:%d", e.ExitCode)
+	}
+	if stderr := strings.TrimSpace(string(e.Stderr)); stderr != "" {
+		msg += fmt.Sprintf(" stderr:%s", stderr)
+	}
+	return msg
+}
+
+func (e *ProxyCommandError) Unwrap() error {
+	return e.Err
+}
+
+// handshakeError converts the error of ssh.NewClientConn into a typed error if possible.
+func handshakeError(err error, user, addr string) error {
+	m := authFailedRe.FindStringSubmatch(err.Error())
+	if m == nil {
+		return err
+	}
+	return &AuthFailedError{
+		User:    user,
+		Addr:    addr,
+		Methods: strings.Fields(m[1]),
+		Err:     err,
+	}
+}
+
+// decodeError converts the error of ssh_config.Decode into *ConfigParseError.
+func decodeError(err error, path string) error {
+	m := decodePositionRe.FindStringSubmatch(strings.TrimSpace(err.Error()))
+	if m == nil {
+		return &ConfigParseError{File: path, Err: err}
+	}
+	line := 0
+	_, _ = fmt.Sscanf(m[1], "%d", &line)
+	return &ConfigParseError{File: path, Line: line, Err: fmt.Errorf("%s", m[2])}
+}
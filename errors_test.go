@@ -0,0 +1,78 @@
+package sshc
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestConfigParseError(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		wantLine int
+	}{
+		{"invalid Match", "Host a\n  User a\n\nMatch unknown x\n", 4},
+		{"invalid Port", "Host a\n  HostName a\n  Port abc\n", 3},
+		{"invalid yes/no", "Host *\n\n  BatchMode maybe\n", 3},
+		{"invalid StrictHostKeyChecking", "StrictHostKeyChecking always\n", 1},
+		{"unsupported Ciphers", "Host a\n  Ciphers aes128-ctr,blowfish-cbc\n", 2},
+		{"no Ciphers left", "Host a\n  Ciphers -*\n", 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConfig(ClearConfig(), ConfigData([]byte(tt.data)))
+			if err == nil {
+				_, err = c.Resolve("a")
+			}
+			var perr *ConfigParseError
+			if !errors.As(err, &perr) {
+				t.Fatalf("got %v", err)
+			}
+			if perr.Line != tt.wantLine {
+				t.Errorf("got %v want %v", perr.Line, tt.wantLine)
+			}
+			if perr.File == "" {
+				t.Error("File should be set")
+			}
+		})
+	}
+}
+
+func TestAuthFailedError(t *testing.T) {
+	srv := newTestServer(t, "server")
+	t.Setenv("HOME", t.TempDir())
+	opts := append(srv.options("  User alice\n"), InsecureIgnoreHostKey(), Password("secret"))
+	_, err := NewClient("server", opts...)
+	var aerr *AuthFailedError
+	if !errors.As(err, &aerr) {
+		t.Fatalf("got %v", err)
+	}
+	if got, want := aerr.User, "alice"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := aerr.Addr, srv.addr; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if len(aerr.Methods) == 0 {
+		t.Error("Methods should be set")
+	}
+}
+
+func TestProxyCommandError(t *testing.T) {
+	_, err := Dial(&DialConfig{
+		Hostname:     "127.0.0.1",
+		Port:         22,
+		ProxyCommand: "echo oops >&2; exit 3",
+	})
+	var perr *ProxyCommandError
+	if !errors.As(err, &perr) {
+		t.Fatalf("got %v", err)
+	}
+	if got, want := perr.ExitCode, 3; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := strings.TrimSpace(string(perr.Stderr)), "oops"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
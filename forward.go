@@ -0,0 +1,294 @@
+package sshc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Forwarding is a port forwarding that accepts connections on a listener and forwards them through *ssh.Client.
+// It stops when Close or Shutdown is called, the context given to start it is done or the client is closed.
+type Forwarding struct {
+	ln     net.Listener
+	ctx    context.Context
+	cancel context.CancelFunc
+	handle func(ctx context.Context, conn net.Conn)
+
+	wg       sync.WaitGroup
+	done     chan struct{}
+	stopping atomic.Bool
+	err      error
+}
+
+// LocalForward listens on localAddr and forwards each connection to remoteAddr through client, like `ssh -L`.
+// localAddr is `[bind_address:]port` or the path of a Unix domain socket. If bind_address is omitted, localhost is used, and `*` means all interfaces.
+// remoteAddr is `host:port` or the path of a Unix domain socket on the remote host.
+func LocalForward(ctx context.Context, client *ssh.Client, localAddr, remoteAddr string) (*Forwarding, error) {
+	network, addr, err := parseListenAddr(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	rnetwork, raddr, err := parseTargetAddr(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	lc := &net.ListenConfig{}
+	ln, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newForwarding(ctx, client, ln, func(ctx context.Context, conn net.Conn) {
+		rconn, err := client.DialContext(ctx, rnetwork, raddr)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		proxyConn(ctx, conn, rconn)
+	}), nil
+}
+
+// RemoteForward requests the remote host to listen on remoteAddr and forwards each connection to localAddr, like `ssh -R`.
+// remoteAddr is `[bind_address:]port` or the path of a Unix domain socket on the remote host. If bind_address is omitted, localhost is requested, and `*` means all interfaces.
+// If port is 0, the remote host allocates a port and Addr of the returned Forwarding reports it.
+// localAddr is `host:port` or the path of a Unix domain socket.
+func RemoteForward(ctx context.Context, client *ssh.Client, remoteAddr, localAddr string) (*Forwarding, error) {
+	network, addr, err := parseListenAddr(remoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	lnetwork, laddr, err := parseTargetAddr(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ln, err := client.Listen(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newForwarding(ctx, client, ln, func(ctx context.Context, conn net.Conn) {
+		d := &net.Dialer{}
+		lconn, err := d.DialContext(ctx, lnetwork, laddr)
+		if err != nil {
+			_ = conn.Close()
+			return
+		}
+		proxyConn(ctx, conn, lconn)
+	}), nil
+}
+
+// newForwarding starts serving ln with handle until ctx is done, client is closed or Close is called.
+func newForwarding(ctx context.Context, client *ssh.Client, ln net.Listener, handle func(ctx context.Context, conn net.Conn)) *Forwarding {
+	fctx, cancel := context.WithCancel(ctx)
+	f := &Forwarding{
+		ln:     ln,
+		ctx:    fctx,
+		cancel: cancel,
+		handle: handle,
+		done:   make(chan struct{}),
+	}
+	go func() {
+		select {
+		case <-fctx.Done():
+		case <-clientDone(client):
+			cancel()
+		}
+		_ = ln.Close()
+	}()
+	go f.serve()
+	return f
+}
+
+var (
+	clientDonesMu sync.Mutex
+	clientDones   = map[*ssh.Client]chan struct{}{}
+)
+
+// clientDone returns the channel that is closed when client is closed.
+// One goroutine per client waits for it, however many forwardings use the client.
+func clientDone(client *ssh.Client) <-chan struct{} {
+	clientDonesMu.Lock()
+	defer clientDonesMu.Unlock()
+	if done, ok := clientDones[client]; ok {
+		return done
+	}
+	done := make(chan struct{})
+	clientDones[client] = done
+	go func() {
+		_ = client.Wait()
+		clientDonesMu.Lock()
+		delete(clientDones, client)
+		clientDonesMu.Unlock()
+		close(done)
+	}()
+	return done
+}
+
+// Addr returns the address of the listener.
+func (f *Forwarding) Addr() net.Addr {
+	return f.ln.Addr()
+}
+
+// Close stops the forwarding, closes the connections being forwarded and waits for them.
+func (f *Forwarding) Close() error {
+	f.cancel()
+	<-f.done
+	return nil
+}
+
+// Shutdown stops accepting connections and waits for the connections being forwarded to finish.
+// If ctx is done before they finish, they are closed and ctx.Err() is returned.
+func (f *Forwarding) Shutdown(ctx context.Context) error {
+	f.stopping.Store(true)
+	_ = f.ln.Close()
+	select {
+	case <-f.done:
+		return nil
+	case <-ctx.Done():
+		_ = f.Close()
+		return ctx.Err()
+	}
+}
+
+// Wait waits for the forwarding to stop. It returns the error of the listener if the forwarding stopped because of it.
+func (f *Forwarding) Wait() error {
+	<-f.done
+	return f.err
+}
+
+func (f *Forwarding) serve() {
+	defer close(f.done)
+	for {
+		conn, err := f.ln.Accept()
+		if err != nil {
+			if f.ctx.Err() == nil && !f.stopping.Load() {
+				f.err = err
+				f.cancel()
+			}
+			break
+		}
+		f.wg.Add(1)
+		go func() {
+			defer f.wg.Done()
+			f.handle(f.ctx, conn)
+		}()
+	}
+	f.wg.Wait()
+	f.cancel()
+}
+
+// proxyConn copies data between a and b until both directions are done or ctx is done, and then closes them.
+func proxyConn(ctx context.Context, a, b net.Conn) {
+	stop := context.AfterFunc(ctx, func() {
+		_ = a.Close()
+		_ = b.Close()
+	})
+	defer stop()
+	var wg sync.WaitGroup
+	wg.Add(2)
+	cp := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, _ = io.Copy(dst, src)
+		if c, ok := dst.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+	}
+	go cp(a, b)
+	go cp(b, a)
+	wg.Wait()
+	_ = a.Close()
+	_ = b.Close()
+}
+
+// parseForward parses the value of LocalForward or RemoteForward ( `listen target` ) of ssh_config.
+func parseForward(v string) (string, string, error) {
+	fields := strings.Fields(v)
+	if len(fields) != 2 {
+		return "", "", fmt.Errorf("invalid forwarding %q", v)
+	}
+	return fields[0], fields[1], nil
+}
+
+// parseListenAddr parses `[bind_address:]port` or the path of a Unix domain socket and returns the network and the address to listen on.
+func parseListenAddr(v string) (string, string, error) {
+	if isSocketPath(v) {
+		return "unix", v, nil
+	}
+	bind := "localhost"
+	port := v
+	if i := strings.LastIndex(v, ":"); i >= 0 {
+		bind, port = strings.Trim(v[:i], "[]"), v[i+1:]
+		if bind == "*" {
+			bind = ""
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid port in %q", v)
+	}
+	return "tcp", net.JoinHostPort(bind, port), nil
+}
+
+// parseTargetAddr parses `host:port` or the path of a Unix domain socket and returns the network and the address to connect to.
+func parseTargetAddr(v string) (string, string, error) {
+	if isSocketPath(v) {
+		return "unix", v, nil
+	}
+	host, port, err := net.SplitHostPort(v)
+	if err != nil {
+		return "", "", err
+	}
+	if host == "" {
+		return "", "", fmt.Errorf("missing host in %q", v)
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", "", fmt.Errorf("invalid port in %q", v)
+	}
+	return "tcp", v, nil
+}
+
+func isSocketPath(v string) bool {
+	return strings.Contains(v, "/")
+}
+
+// startForwards starts the LocalForward, RemoteForward and DynamicForward of r on client.
+// If a forwarding fails to start, it is an error only when ExitOnForwardFailure is set, as OpenSSH does.
+func startForwards(client *ssh.Client, r *ResolvedHost) error {
+	var errs []error
+	forwards := []struct {
+		key   string
+		specs []string
+		start func(ctx context.Context, client *ssh.Client, listen, target string) (*Forwarding, error)
+	}{
+		{"LocalForward", r.LocalForwards, LocalForward},
+		{"RemoteForward", r.RemoteForwards, RemoteForward},
+	}
+	for _, f := range forwards {
+		for _, v := range f.specs {
+			l, t, err := parseForward(v)
+			if err == nil {
+				_, err = f.start(context.Background(), client, l, t)
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s: %w", f.key, v, err))
+			}
+		}
+	}
+	for _, v := range r.DynamicForwards {
+		if _, err := DynamicForward(context.Background(), client, v); err != nil {
+			errs = append(errs, fmt.Errorf("DynamicForward %s: %w", v, err))
+		}
+	}
+	if !r.ExitOnForwardFailure {
+		return nil
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,382 @@
+package sshc
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestLocalForward(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	sockDir := shortTempDir(t)
+	echoSock := newEchoServer(t, "unix", filepath.Join(sockDir, "echo.sock"))
+
+	tests := []struct {
+		name       string
+		localAddr  string
+		remoteAddr string
+	}{
+		{"tcp to tcp", "127.0.0.1:0", echo},
+		{"unix to tcp", filepath.Join(sockDir, "local.sock"), echo},
+		{"tcp to unix", "127.0.0.1:0", echoSock},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, srv)
+			f, err := LocalForward(context.Background(), client, tt.localAddr, tt.remoteAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = f.Close()
+			})
+			assertEcho(t, f.Addr().Network(), f.Addr().String())
+		})
+	}
+
+	t.Run("Close", func(t *testing.T) {
+		client := newTestClient(t, srv)
+		f, err := LocalForward(context.Background(), client, "127.0.0.1:0", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := net.Dial("tcp", f.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// the connection being forwarded is closed
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+			t.Errorf("got %v want %v", err, io.EOF)
+		}
+		if _, err := net.Dial("tcp", f.Addr().String()); err == nil {
+			t.Error("listener should be closed")
+		}
+	})
+
+	t.Run("stops when the client is closed", func(t *testing.T) {
+		client := newTestClient(t, srv)
+		f, err := LocalForward(context.Background(), client, "127.0.0.1:0", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.Close()
+		if err := f.Wait(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("stops when ctx is canceled", func(t *testing.T) {
+		client := newTestClient(t, srv)
+		ctx, cancel := context.WithCancel(context.Background())
+		f, err := LocalForward(ctx, client, "127.0.0.1:0", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cancel()
+		if err := f.Wait(); err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("invalid address", func(t *testing.T) {
+		client := newTestClient(t, srv)
+		for _, addrs := range [][2]string{{"abc", echo}, {"127.0.0.1:0", "localhost"}, {"127.0.0.1:0", ":80"}} {
+			if _, err := LocalForward(context.Background(), client, addrs[0], addrs[1]); err == nil {
+				t.Errorf("%v: want error", addrs)
+			}
+		}
+	})
+}
+
+func TestRemoteForward(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	echoSock := newEchoServer(t, "unix", filepath.Join(shortTempDir(t), "echo.sock"))
+
+	tests := []struct {
+		name       string
+		remoteAddr string
+		localAddr  string
+	}{
+		{"to tcp", "127.0.0.1:0", echo},
+		{"to unix", "127.0.0.1:0", echoSock},
+		{"without bind address", "0", echo},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client := newTestClient(t, srv)
+			f, err := RemoteForward(context.Background(), client, tt.remoteAddr, tt.localAddr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = f.Close()
+			})
+			port := f.Addr().(*net.TCPAddr).Port
+			assertEcho(t, "tcp", net.JoinHostPort("localhost", strconv.Itoa(port)))
+		})
+	}
+
+	t.Run("Close cancels the remote listener", func(t *testing.T) {
+		client := newTestClient(t, srv)
+		f, err := RemoteForward(context.Background(), client, "127.0.0.1:0", echo)
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := f.Addr().String()
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+		// cancel-tcpip-forward is handled asynchronously by the server
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				break
+			}
+			_ = conn.Close()
+			if time.Now().After(deadline) {
+				t.Fatal("remote listener should be closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("denied", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ln.Close()
+		client := newTestClient(t, srv)
+		if _, err := RemoteForward(context.Background(), client, ln.Addr().String(), echo); err == nil {
+			t.Error("want error")
+		}
+	})
+}
+
+func TestForwardingDoesNotLeakGoroutines(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	client := newTestClient(t, srv)
+	forwards := []func() (*Forwarding, error){
+		func() (*Forwarding, error) {
+			return LocalForward(context.Background(), client, "127.0.0.1:0", echo)
+		},
+		func() (*Forwarding, error) {
+			return RemoteForward(context.Background(), client, "127.0.0.1:0", echo)
+		},
+		func() (*Forwarding, error) {
+			return DynamicForward(context.Background(), client, "127.0.0.1:0")
+		},
+	}
+	run := func() {
+		for _, forward := range forwards {
+			f, err := forward()
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = f.Close()
+			f, err = forward()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := f.Shutdown(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	run()
+	before := runtime.NumGoroutine()
+	for range 50 {
+		run()
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		n := runtime.NumGoroutine()
+		if n <= before {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines got %v want <= %v", n, before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestUseForwards(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	sockDir := shortTempDir(t)
+	busy := filepath.Join(sockDir, "busy.sock")
+	ln, err := net.Listen("unix", busy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	// the port is in use on the remote host ( same as local in tests )
+	ln2, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln2.Close()
+	})
+
+	tests := []struct {
+		name    string
+		config  string
+		wantErr bool
+	}{
+		{"LocalForward", fmt.Sprintf("  LocalForward %s %s\n", filepath.Join(sockDir, "ok.sock"), echo), false},
+		{"failure is ignored", fmt.Sprintf("  LocalForward %s %s\n", busy, echo), false},
+		{"ExitOnForwardFailure", fmt.Sprintf("  LocalForward %s %s\n  ExitOnForwardFailure yes\n", busy, echo), true},
+		{"RemoteForward", fmt.Sprintf("  RemoteForward 127.0.0.1:0 %s\n  ExitOnForwardFailure yes\n", echo), false},
+		{"RemoteForward failure is ignored", fmt.Sprintf("  RemoteForward %s %s\n", ln2.Addr(), echo), false},
+		{"RemoteForward with ExitOnForwardFailure", fmt.Sprintf("  RemoteForward %s %s\n  ExitOnForwardFailure yes\n", ln2.Addr(), echo), true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			opts := append(srv.optionsWithKey(t, tt.config), InsecureIgnoreHostKey(), UseForwards(true))
+			client, err := NewClient("server", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+		})
+	}
+
+	t.Run("forwarding through NewClient", func(t *testing.T) {
+		t.Setenv("HOME", t.TempDir())
+		sock := filepath.Join(sockDir, "client.sock")
+		opts := append(srv.optionsWithKey(t, fmt.Sprintf("  LocalForward %s %s\n", sock, echo)), InsecureIgnoreHostKey(), UseForwards(true))
+		client, err := NewClient("server", opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertEcho(t, "unix", sock)
+		_ = client.Close()
+	})
+}
+
+func TestParseListenAddr(t *testing.T) {
+	tests := []struct {
+		in          string
+		wantNetwork string
+		wantAddr    string
+		wantErr     bool
+	}{
+		{"8080", "tcp", "localhost:8080", false},
+		{"127.0.0.1:8080", "tcp", "127.0.0.1:8080", false},
+		{"*:8080", "tcp", ":8080", false},
+		{"[::1]:8080", "tcp", "[::1]:8080", false},
+		{"/tmp/sshc.sock", "unix", "/tmp/sshc.sock", false},
+		{"localhost:http", "", "", true},
+		{"70000", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			network, addr, err := parseListenAddr(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if network != tt.wantNetwork || addr != tt.wantAddr {
+				t.Errorf("got %v %v want %v %v", network, addr, tt.wantNetwork, tt.wantAddr)
+			}
+		})
+	}
+}
+
+// newTestClient returns *ssh.Client connected to srv.
+func newTestClient(t *testing.T, srv *testServer) *ssh.Client {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	client, err := NewClient("server", append(srv.optionsWithKey(t, ""), InsecureIgnoreHostKey())...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = client.Close()
+	})
+	return client
+}
+
+// newEchoServer starts a server that echoes each line and returns its address.
+func newEchoServer(t *testing.T, network, addr string) string {
+	t.Helper()
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// assertEcho sends a line to addr and checks that it is echoed back.
+func assertEcho(t *testing.T, network, addr string) {
+	t.Helper()
+	conn, err := net.Dial(network, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	got, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "hello\n"; got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
+// shortTempDir returns a temporary directory with a short path for Unix domain sockets.
+func shortTempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "sshc")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	return dir
+}
@@ -90,6 +90,20 @@ func TestSSH(t *testing.T) {
 	})
 }
 
+func TestSSHProxyJump(t *testing.T) {
+	if !*integration {
+		t.Skip()
+	}
+	got, err := getHostname("server-jump", false, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "server\n"
+	if got != want {
+		t.Fatalf("want = %#v, got = %#v", want, got)
+	}
+}
+
 func TestDialTimeoutFunc(t *testing.T) {
 	opts := []Option{
 		ConfigPath("./testdata/ssh_config"),
@@ -0,0 +1,368 @@
+package sshc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	strictHostKeyCheckingYes       = "yes"
+	strictHostKeyCheckingNo        = "no"
+	strictHostKeyCheckingAsk       = "ask"
+	strictHostKeyCheckingAcceptNew = "accept-new"
+)
+
+// noAuthoritiesErrPrefix is the prefix of the error of ssh.CertChecker when no CA is trusted for the host.
+const noAuthoritiesErrPrefix = "ssh: no authorities for hostname"
+
+// knownHostsMu serializes writes to known_hosts files within the process.
+// Writes across processes are serialized by file locking.
+var knownHostsMu sync.Mutex
+
+// getStrictHostKeyChecking returns the policy for host key verification.
+// The StrictHostKeyChecking option takes precedence, and the Knownhosts option implies "yes".
+func (c *Config) getStrictHostKeyChecking(host string) (string, error) {
+	if c.strictHostKey != "" {
+		return c.strictHostKey, nil
+	}
+	if len(c.knownhosts) > 0 {
+		return strictHostKeyCheckingYes, nil
+	}
+	v, err := parseStrictHostKeyChecking(c.getRaw(host, "StrictHostKeyChecking"))
+	if err != nil {
+		return "", c.valueError(host, "StrictHostKeyChecking", err)
+	}
+	return v, nil
+}
+
+func parseStrictHostKeyChecking(v string) (string, error) {
+	switch strings.ToLower(v) {
+	case "yes", "true":
+		return strictHostKeyCheckingYes, nil
+	case "no", "off", "false":
+		return strictHostKeyCheckingNo, nil
+	case "ask", "":
+		return strictHostKeyCheckingAsk, nil
+	case "accept-new":
+		return strictHostKeyCheckingAcceptNew, nil
+	}
+	return "", fmt.Errorf("must be 'yes', 'no', 'ask' or 'accept-new', got %q", v)
+}
+
+// hostKeyCallback returns ssh.HostKeyCallback that verifies host keys against the known_hosts files of dc
+// according to dc.StrictHostKeyChecking.
+// direct reports whether the host is dialed directly, so that the IP address of the remote address is the one of the host.
+func hostKeyCallback(dc *DialConfig, direct bool) (ssh.HostKeyCallback, error) {
+	if dc.InsecureIgnoreHostKey {
+		return ssh.InsecureIgnoreHostKey(), nil // #nosec
+	}
+	strict := dc.StrictHostKeyChecking
+	if strict == "" {
+		if len(dc.knownhostsFiles()) == 0 && len(dc.HostCertAuthorities) == 0 {
+			return ssh.InsecureIgnoreHostKey(), nil // #nosec
+		}
+		strict = strictHostKeyCheckingYes
+	}
+	strict, err := parseStrictHostKeyChecking(strict)
+	if err != nil {
+		return nil, err
+	}
+	files := existingFiles(dc.knownhostsFiles())
+	var cb ssh.HostKeyCallback
+	if len(files) > 0 {
+		cb, err = knownhosts.New(files...)
+		if err != nil {
+			return nil, err
+		}
+	}
+	verify := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		err := &knownhosts.KeyError{}
+		if cb != nil {
+			cerr := cb(hostname, remote, key)
+			if cerr == nil || !errors.As(cerr, &err) {
+				return cerr
+			}
+		}
+		if len(err.Want) == 0 {
+			// unknown host
+			switch strict {
+			case strictHostKeyCheckingAsk:
+				ok, perr := dc.prompter().HostKeyPrompt(knownhosts.Normalize(hostname), remote, key)
+				if perr != nil {
+					return fmt.Errorf("no host key is known for %s and StrictHostKeyChecking is %s: %w", hostname, strict, perr)
+				}
+				if !ok {
+					return fmt.Errorf("host key for %s is not accepted: %w", hostname, err)
+				}
+				fallthrough
+			case strictHostKeyCheckingNo, strictHostKeyCheckingAcceptNew:
+				// failing to record the host key does not prevent the connection, as OpenSSH does
+				_ = dc.addKnownHost(hostname, remote, key)
+				return nil
+			}
+			return fmt.Errorf("no host key is known for %s and StrictHostKeyChecking is %s: %w", hostname, strict, err)
+		}
+		if strict == strictHostKeyCheckingNo {
+			// OpenSSH also allows the connection to proceed
+			return nil
+		}
+		return newHostKeyMismatchError(hostname, key, err)
+	}
+	verifyHost := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		cert, ok := key.(*ssh.Certificate)
+		if !ok || cert.CertType != ssh.HostCert {
+			return verify(hostname, remote, key)
+		}
+		trusted, err := verifyHostCertificate(cb, dc.HostCertAuthorities, hostname, remote, cert)
+		if trusted || err != nil {
+			return err
+		}
+		// No CA is trusted for the certificate. Retry with the plain key as OpenSSH does
+		return verify(hostname, remote, cert.Key)
+	}
+	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		hostname = dc.hostKeyHostname(hostname)
+		if err := verifyHost(hostname, remote, key); err != nil {
+			return err
+		}
+		if !dc.CheckHostIP || !direct || dc.HostKeyAlias != "" {
+			return nil
+		}
+		return verifyHostIP(dc, cb, strict, hostname, remote, key)
+	}, nil
+}
+
+// verifyHostIP verifies the host key for the IP address of remote, after the host key for hostname is verified.
+// If the IP address is unknown, it is added to known_hosts as OpenSSH does. If the host key for the IP address differs, it is an error only when strict is yes.
+func verifyHostIP(dc *DialConfig, cb ssh.HostKeyCallback, strict, hostname string, remote net.Addr, key ssh.PublicKey) error {
+	tcpAddr, ok := remote.(*net.TCPAddr)
+	if !ok {
+		return nil
+	}
+	if cert, ok := key.(*ssh.Certificate); ok {
+		key = cert.Key
+	}
+	_, port, err := net.SplitHostPort(hostname)
+	if err != nil {
+		return err
+	}
+	ip := net.JoinHostPort(tcpAddr.IP.String(), port)
+	if ip == hostname {
+		return nil
+	}
+	keyErr := &knownhosts.KeyError{}
+	if cb != nil {
+		cerr := cb(ip, remote, key)
+		if cerr == nil {
+			return nil
+		}
+		if !errors.As(cerr, &keyErr) {
+			return cerr
+		}
+	}
+	if len(keyErr.Want) == 0 {
+		// failing to record the IP address does not prevent the connection
+		_ = dc.addKnownHost(ip, remote, key)
+		return nil
+	}
+	if strict == strictHostKeyCheckingYes {
+		return newHostKeyMismatchError(ip, key, keyErr)
+	}
+	return nil
+}
+
+// knownhostsFiles returns the known_hosts files to read.
+func (dc *DialConfig) knownhostsFiles() []string {
+	return append(append([]string{}, dc.Knownhosts...), dc.GlobalKnownhosts...)
+}
+
+// addKnownHost records key for hostname in the first file of Knownhosts. GlobalKnownhosts are never written.
+func (dc *DialConfig) addKnownHost(hostname string, remote net.Addr, key ssh.PublicKey) error {
+	if len(dc.Knownhosts) == 0 {
+		return nil
+	}
+	return addKnownHost(dc.Knownhosts[0], hostname, remote, key, dc.HashKnownHosts)
+}
+
+// hostKeyHostname returns the name to look up the host key of addr in known_hosts.
+func (dc *DialConfig) hostKeyHostname(addr string) string {
+	if dc.HostKeyAlias != "" {
+		// same as OpenSSH, the alias is looked up without the port
+		return net.JoinHostPort(dc.HostKeyAlias, "22")
+	}
+	return addr
+}
+
+// orderHostKeyAlgorithms returns the default host key algorithms with the ones of the host keys recorded in files for hostname first, as OpenSSH does.
+// If a CA of @cert-authority is recorded for hostname, the certificate algorithms come first.
+// If nothing is recorded for hostname, nil ( the default of x/crypto/ssh ) is returned.
+func orderHostKeyAlgorithms(files []string, hostname string) ([]string, error) {
+	defaults := defaultHostKeyAlgorithms
+	if len(files) == 0 {
+		return nil, nil
+	}
+	cb, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, err
+	}
+	remote := &net.TCPAddr{}
+	var preferred []string
+	for _, f := range files {
+		b, err := os.ReadFile(f) // #nosec G304
+		if err != nil {
+			return nil, err
+		}
+		for len(b) > 0 {
+			marker, _, key, _, rest, err := ssh.ParseKnownHosts(b)
+			if err != nil {
+				// io.EOF or an invalid line that knownhosts.New has already rejected
+				break
+			}
+			b = rest
+			switch marker {
+			case "":
+				if cb(hostname, remote, key) == nil {
+					preferred = append(preferred, algorithmsForKeyType(key.Type())...)
+				}
+			case "cert-authority":
+				// The CA is checked before the signature, so an unsigned certificate is enough to know whether the CA is for hostname
+				probe := &ssh.Certificate{Key: key, CertType: ssh.HostCert, SignatureKey: key, Signature: &ssh.Signature{Format: key.Type()}}
+				if err := cb(hostname, remote, probe); err != nil && !strings.HasPrefix(err.Error(), noAuthoritiesErrPrefix) {
+					for _, a := range defaults {
+						if strings.HasSuffix(a, "-cert-v01@openssh.com") {
+							preferred = append(preferred, a)
+						}
+					}
+				}
+			}
+		}
+	}
+	if len(preferred) == 0 {
+		return nil, nil
+	}
+	var algos []string
+	for _, a := range defaults {
+		if slices.Contains(preferred, a) {
+			algos = append(algos, a)
+		}
+	}
+	for _, a := range defaults {
+		if !slices.Contains(algos, a) {
+			algos = append(algos, a)
+		}
+	}
+	return algos, nil
+}
+
+func existingFiles(files []string) []string {
+	var existing []string
+	for _, f := range files {
+		if _, err := os.Stat(f); err != nil {
+			continue
+		}
+		existing = append(existing, f)
+	}
+	return existing
+}
+
+// verifyHostCertificate verifies the host certificate against the @cert-authority and @revoked lines of known_hosts ( through cb ) and cas.
+// It reports whether a trusted CA signed the certificate. If the certificate or its keys are revoked, or the certificate is invalid, an error is returned.
+func verifyHostCertificate(cb ssh.HostKeyCallback, cas []ssh.PublicKey, hostname string, remote net.Addr, cert *ssh.Certificate) (bool, error) {
+	if cb != nil {
+		// @revoked lines for the certified key and the CA key
+		for _, k := range []ssh.PublicKey{cert.Key, cert.SignatureKey} {
+			var revoked *knownhosts.RevokedError
+			if err := cb(hostname, remote, k); errors.As(err, &revoked) {
+				return false, err
+			}
+		}
+	}
+	isHostAuthority := func(auth ssh.PublicKey, address string) bool {
+		for _, ca := range cas {
+			if bytes.Equal(ca.Marshal(), auth.Marshal()) {
+				return true
+			}
+		}
+		return false
+	}
+	if cb != nil {
+		err := cb(hostname, remote, cert)
+		if err == nil {
+			return true, nil
+		}
+		if !strings.HasPrefix(err.Error(), noAuthoritiesErrPrefix) {
+			// revoked, or signed by a CA of known_hosts but invalid ( expired, wrong principal, ... )
+			return false, err
+		}
+	}
+	if !isHostAuthority(cert.SignatureKey, hostname) {
+		return false, nil
+	}
+	checker := &ssh.CertChecker{IsHostAuthority: isHostAuthority}
+	if err := checker.CheckHostKey(hostname, remote, cert); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// addKnownHost appends key for hostname to the known_hosts file.
+func addKnownHost(file, hostname string, remote net.Addr, key ssh.PublicKey, hash bool) error {
+	if file == os.DevNull {
+		return nil
+	}
+	knownHostsMu.Lock()
+	defer knownHostsMu.Unlock()
+	if err := os.MkdirAll(filepath.Dir(file), 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(file, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0600) // #nosec G304
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := lockFile(f); err != nil {
+		return err
+	}
+	defer func() {
+		_ = unlockFile(f)
+	}()
+
+	// Another process may have added the host key while waiting for the lock
+	if cb, err := knownhosts.New(file); err == nil {
+		if err := cb(hostname, remote, key); err == nil {
+			return nil
+		}
+	}
+
+	addr := knownhosts.Normalize(hostname)
+	if hash {
+		addr = knownhosts.HashHostname(addr)
+	}
+	line := knownhosts.Line([]string{addr}, key) + "\n"
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if fi.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err := f.ReadAt(last, fi.Size()-1); err != nil && !errors.Is(err, io.EOF) {
+			return err
+		}
+		if last[0] != '\n' {
+			line = "\n" + line
+		}
+	}
+	_, err = f.WriteString(line)
+	return err
+}
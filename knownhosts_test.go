@@ -0,0 +1,540 @@
+package sshc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+func TestStrictHostKeyChecking(t *testing.T) {
+	srv := newTestServer(t, "server")
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostport := knownhosts.Normalize(srv.addr)
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		strict     string
+		opts       []Option
+		wantErr    bool
+	}{
+		{"yes known", knownhosts.Line([]string{hostport}, srv.hostKey.PublicKey()), "yes", nil, false},
+		{"yes unknown", "", "yes", nil, true},
+		{"yes mismatch", knownhosts.Line([]string{hostport}, other.PublicKey()), "yes", nil, true},
+		{"ask unknown", "", "ask", []Option{UsePrompter(NonInteractivePrompter{})}, true},
+		{"ask accepted", "", "ask", []Option{UsePrompter(&testPrompter{acceptKey: true})}, false},
+		{"ask declined", "", "ask", []Option{UsePrompter(&testPrompter{})}, true},
+		{"ask mismatch", knownhosts.Line([]string{hostport}, other.PublicKey()), "ask", []Option{UsePrompter(&testPrompter{acceptKey: true})}, true},
+		{"default unknown", "", "", []Option{UsePrompter(NonInteractivePrompter{})}, true},
+		{"accept-new unknown", "", "accept-new", nil, false},
+		{"accept-new mismatch", knownhosts.Line([]string{hostport}, other.PublicKey()), "accept-new", nil, true},
+		{"no unknown", "", "no", nil, false},
+		{"no mismatch", knownhosts.Line([]string{hostport}, other.PublicKey()), "no", nil, false},
+		{"option overrides config", "", "yes", []Option{StrictHostKeyChecking("no")}, false},
+		{"insecure", knownhosts.Line([]string{hostport}, other.PublicKey()), "yes", []Option{InsecureIgnoreHostKey()}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, "known_hosts")
+			if err := os.WriteFile(kh, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n", kh)
+			if tt.strict != "" {
+				config += fmt.Sprintf("  StrictHostKeyChecking %s\n", tt.strict)
+			}
+			opts := append(srv.optionsWithKey(t, config), tt.opts...)
+			client, err := NewClient("server", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+func TestStrictHostKeyCheckingAsk(t *testing.T) {
+	srv := newTestServer(t, "server")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	kh := filepath.Join(home, "known_hosts")
+	config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n  StrictHostKeyChecking ask\n", kh)
+
+	p := &testPrompter{acceptKey: true}
+	client, err := NewClient("server", append(srv.optionsWithKey(t, config), UsePrompter(p))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if got, want := p.hostKeys, []string{knownhosts.Normalize(srv.addr)}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	// The accepted host key is recorded and not asked again
+	p = &testPrompter{}
+	client, err = NewClient("server", append(srv.optionsWithKey(t, config), UsePrompter(p))...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = client.Close()
+	if len(p.hostKeys) != 0 {
+		t.Errorf("got %v", p.hostKeys)
+	}
+
+	// BatchMode never asks
+	if err := os.Remove(kh); err != nil {
+		t.Fatal(err)
+	}
+	p = &testPrompter{acceptKey: true}
+	if _, err := NewClient("server", append(srv.optionsWithKey(t, config+"  BatchMode yes\n"), UsePrompter(p))...); !errors.Is(err, ErrPromptNotAllowed) {
+		t.Errorf("got %v want %v", err, ErrPromptNotAllowed)
+	}
+}
+
+func TestKnownhostsOptionImpliesStrict(t *testing.T) {
+	c, err := NewConfig(ClearConfig(), ConfigData([]byte("Host *\n  StrictHostKeyChecking no\n")), Knownhosts("/path/to/known_hosts"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Resolve("server")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.StrictHostKeyChecking, "yes"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.UserKnownHostsFiles, []string{"/path/to/known_hosts"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestAcceptNewAddsKnownHost(t *testing.T) {
+	srv := newTestServer(t, "server")
+	for _, hash := range []string{"no", "yes"} {
+		t.Run("HashKnownHosts "+hash, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, ".ssh", "known_hosts")
+			config := fmt.Sprintf("  GlobalKnownHostsFile none\n  HashKnownHosts %s\n", hash)
+			opts := append(srv.optionsWithKey(t, config), StrictHostKeyChecking("accept-new"))
+
+			var wg sync.WaitGroup
+			for i := 0; i < 5; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					client, err := NewClient("server", opts...)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					_ = client.Close()
+				}()
+			}
+			wg.Wait()
+
+			b, err := os.ReadFile(kh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+			if len(lines) != 1 {
+				t.Fatalf("got %d lines: %s", len(lines), b)
+			}
+			if hashed := strings.HasPrefix(lines[0], "|1|"); hashed != (hash == "yes") {
+				t.Errorf("got %s", lines[0])
+			}
+
+			// The recorded host key is trusted
+			client, err := NewClient("server", append(srv.optionsWithKey(t, config), StrictHostKeyChecking("yes"))...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = client.Close()
+		})
+	}
+}
+
+func TestAcceptNewDoesNotWriteGlobalKnownHosts(t *testing.T) {
+	srv := newTestServer(t, "server")
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	global := filepath.Join(home, "ssh_known_hosts")
+	if err := os.WriteFile(global, nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// the parent of the user file is not a directory, so the user file cannot be written
+	unwritable := filepath.Join(global, "known_hosts")
+
+	tests := []struct {
+		name string
+		user string
+	}{
+		{"UserKnownHostsFile none", "none"},
+		{"failing to write UserKnownHostsFile", unwritable},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile %s\n  StrictHostKeyChecking accept-new\n", tt.user, global)
+			client, err := NewClient("server", srv.optionsWithKey(t, config)...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = client.Close()
+			b, err := os.ReadFile(global)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(b) != 0 {
+				t.Errorf("GlobalKnownHostsFile should not be written: %s", b)
+			}
+		})
+	}
+}
+
+func TestHostKeyMismatchError(t *testing.T) {
+	srv := newTestServer(t, "server")
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	kh := filepath.Join(home, "known_hosts")
+	if err := os.WriteFile(kh, []byte(knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, other.PublicKey())+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	config := fmt.Sprintf("  UserKnownHostsFile %s\n  StrictHostKeyChecking accept-new\n", kh)
+	_, err = NewClient("server", srv.optionsWithKey(t, config)...)
+	var mismatch *HostKeyMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Fatalf("got %v", err)
+	}
+	if len(mismatch.Want) != 1 || mismatch.KnownHostsLine != 1 || mismatch.KnownHostsFile != kh {
+		t.Errorf("got %v", mismatch)
+	}
+	if got, want := mismatch.ActualFingerprint, ssh.FingerprintSHA256(srv.hostKey.PublicKey()); got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := mismatch.ExpectedFingerprints, []string{ssh.FingerprintSHA256(other.PublicKey())}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+	b, err := os.ReadFile(kh)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(b), "\n"); got != 1 {
+		t.Errorf("known_hosts should not be modified: %s", b)
+	}
+}
+
+func TestHostCertificate(t *testing.T) {
+	_, caPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ca, err := ssh.NewSignerFromKey(caPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	caLine := string(ssh.MarshalAuthorizedKey(ca.PublicKey()))
+
+	// withHostCertificate makes the server present the host certificate signed by ca
+	withHostCertificate := func(principal string, validBefore uint64) testServerOption {
+		return func(s *testServer) {
+			cert := &ssh.Certificate{
+				Key:             s.hostKey.PublicKey(),
+				CertType:        ssh.HostCert,
+				KeyId:           s.name,
+				ValidPrincipals: []string{principal},
+				ValidBefore:     validBefore,
+			}
+			if err := cert.SignCert(rand.Reader, ca); err != nil {
+				t.Fatal(err)
+			}
+			signer, err := ssh.NewCertSigner(cert, s.hostKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.config.AddHostKey(signer)
+		}
+	}
+	srv := newTestServer(t, "server", withHostCertificate("127.0.0.1", ssh.CertTimeInfinity))
+	wrongPrincipal := newTestServer(t, "wrong", withHostCertificate("example.com", ssh.CertTimeInfinity))
+	expired := newTestServer(t, "expired", withHostCertificate("127.0.0.1", 1))
+
+	tests := []struct {
+		name       string
+		srv        *testServer
+		knownHosts func(s *testServer) string
+		opts       []Option
+		wantErr    bool
+	}{
+		{"@cert-authority", srv, func(s *testServer) string {
+			return "@cert-authority " + knownhosts.Normalize(s.addr) + " " + caLine
+		}, nil, false},
+		{"@cert-authority for other host", srv, func(s *testServer) string {
+			return "@cert-authority example.com " + caLine
+		}, nil, true},
+		{"plain key", srv, func(s *testServer) string {
+			return knownhosts.Line([]string{knownhosts.Normalize(s.addr)}, s.hostKey.PublicKey())
+		}, nil, false},
+		{"@revoked host key", srv, func(s *testServer) string {
+			return "@cert-authority " + knownhosts.Normalize(s.addr) + " " + caLine +
+				"@revoked * " + string(ssh.MarshalAuthorizedKey(s.hostKey.PublicKey()))
+		}, nil, true},
+		{"@revoked CA", srv, func(s *testServer) string {
+			return "@cert-authority " + knownhosts.Normalize(s.addr) + " " + caLine +
+				"@revoked * " + caLine
+		}, nil, true},
+		{"wrong principal", wrongPrincipal, func(s *testServer) string {
+			return "@cert-authority " + knownhosts.Normalize(s.addr) + " " + caLine
+		}, nil, true},
+		{"expired", expired, func(s *testServer) string {
+			return "@cert-authority " + knownhosts.Normalize(s.addr) + " " + caLine
+		}, nil, true},
+		{"option", srv, nil, []Option{HostCertAuthority([]byte(caLine))}, false},
+		{"option for other host", srv, nil, []Option{HostCertAuthority([]byte(caLine), "other")}, true},
+		{"option with wrong principal", wrongPrincipal, nil, []Option{HostCertAuthority([]byte(caLine))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, "known_hosts")
+			if tt.knownHosts != nil {
+				if err := os.WriteFile(kh, []byte(tt.knownHosts(tt.srv)+"\n"), 0600); err != nil {
+					t.Fatal(err)
+				}
+			}
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n  StrictHostKeyChecking yes\n", kh)
+			opts := append(tt.srv.optionsWithKey(t, config), tt.opts...)
+			client, err := NewClient("server", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+func TestHostKeyAlias(t *testing.T) {
+	srv := newTestServer(t, "server")
+	tests := []struct {
+		name       string
+		knownHosts string
+		config     string
+		wantErr    bool
+		wantLine   string
+	}{
+		{"known alias", knownhosts.Line([]string{"myalias"}, srv.hostKey.PublicKey()), "  HostKeyAlias myalias\n  StrictHostKeyChecking yes\n", false, ""},
+		{"unknown alias", knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, srv.hostKey.PublicKey()), "  HostKeyAlias myalias\n  StrictHostKeyChecking yes\n", true, ""},
+		{"no alias", knownhosts.Line([]string{"myalias"}, srv.hostKey.PublicKey()), "  StrictHostKeyChecking yes\n", true, ""},
+		{"accept-new records alias", "", "  HostKeyAlias myalias\n  StrictHostKeyChecking accept-new\n", false, knownhosts.Line([]string{"myalias"}, srv.hostKey.PublicKey())},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, "known_hosts")
+			if err := os.WriteFile(kh, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n", kh) + tt.config
+			client, err := NewClient("server", srv.optionsWithKey(t, config)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+			if tt.wantLine == "" {
+				return
+			}
+			b, err := os.ReadFile(kh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(b), tt.wantLine) {
+				t.Errorf("got %s want %s", b, tt.wantLine)
+			}
+		})
+	}
+}
+
+func TestCheckHostIP(t *testing.T) {
+	srv := newTestServer(t, "server")
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	host := knownhosts.Normalize(net.JoinHostPort("localhost", strconv.Itoa(srv.port)))
+	ip := knownhosts.Normalize(srv.addr)
+	hostLine := knownhosts.Line([]string{host}, srv.hostKey.PublicKey())
+	ipLine := knownhosts.Line([]string{ip}, srv.hostKey.PublicKey())
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		config     string
+		wantErr    bool
+		wantIPLine bool
+	}{
+		{"IP is recorded", hostLine, "  CheckHostIP yes\n  StrictHostKeyChecking yes\n", false, true},
+		{"IP is not checked", hostLine, "  CheckHostIP no\n  StrictHostKeyChecking yes\n", false, false},
+		{"IP is not checked by default", hostLine, "  StrictHostKeyChecking yes\n", false, false},
+		{"IP key differs", hostLine + "\n" + knownhosts.Line([]string{ip}, other.PublicKey()), "  CheckHostIP yes\n  StrictHostKeyChecking yes\n", true, false},
+		{"IP key differs without strict", hostLine + "\n" + knownhosts.Line([]string{ip}, other.PublicKey()), "  CheckHostIP yes\n  StrictHostKeyChecking accept-new\n", false, false},
+		{"IP is not checked with HostKeyAlias", knownhosts.Line([]string{"myalias"}, srv.hostKey.PublicKey()), "  CheckHostIP yes\n  HostKeyAlias myalias\n  StrictHostKeyChecking yes\n", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, "known_hosts")
+			if err := os.WriteFile(kh, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n", kh) + tt.config
+			client, err := NewClient("server", append(srv.optionsWithKey(t, config), Hostname("localhost"))...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+			b, err := os.ReadFile(kh)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := strings.Contains(string(b), ipLine); got != tt.wantIPLine {
+				t.Errorf("got %s", b)
+			}
+		})
+	}
+}
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	b, err := os.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+		c.AddHostKey(rsaKey)
+	}))
+	ed25519Line := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, srv.hostKey.PublicKey())
+	rsaLine := knownhosts.Line([]string{knownhosts.Normalize(srv.addr)}, rsaKey.PublicKey())
+
+	tests := []struct {
+		name       string
+		knownHosts string
+		config     string
+		wantErr    bool
+	}{
+		{"ed25519 only", ed25519Line, "", false},
+		{"rsa only", rsaLine, "", false},
+		{"HostKeyAlgorithms overrides known_hosts", ed25519Line, "  HostKeyAlgorithms rsa-sha2-256\n", true},
+		{"HostKeyAlgorithms with ^", rsaLine, "  HostKeyAlgorithms ^rsa-sha2-512\n", false},
+		{"HostKeyAlgorithms with -", rsaLine, "  HostKeyAlgorithms -rsa-*,ssh-rsa\n", true},
+		{"unsupported HostKeyAlgorithms", ed25519Line, "  HostKeyAlgorithms ssh-unknown\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			home := t.TempDir()
+			t.Setenv("HOME", home)
+			kh := filepath.Join(home, "known_hosts")
+			if err := os.WriteFile(kh, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			config := fmt.Sprintf("  UserKnownHostsFile %s\n  GlobalKnownHostsFile none\n  StrictHostKeyChecking yes\n", kh) + tt.config
+			client, err := NewClient("server", srv.optionsWithKey(t, config)...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+		})
+	}
+}
+
+func TestOrderHostKeyAlgorithms(t *testing.T) {
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name       string
+		knownHosts string
+		want       string
+	}{
+		{"ed25519", knownhosts.Line([]string{"example.com"}, key.PublicKey()), ssh.KeyAlgoED25519},
+		{"other host", knownhosts.Line([]string{"example.org"}, key.PublicKey()), ""},
+		{"cert-authority", "@cert-authority *.com " + string(ssh.MarshalAuthorizedKey(key.PublicKey())) + knownhosts.Line([]string{"example.com"}, key.PublicKey()), defaultHostKeyAlgorithms[0]},
+		{"cert-authority for other host", "@cert-authority *.org " + string(ssh.MarshalAuthorizedKey(key.PublicKey())) + knownhosts.Line([]string{"example.com"}, key.PublicKey()), ssh.KeyAlgoED25519},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kh := filepath.Join(t.TempDir(), "known_hosts")
+			if err := os.WriteFile(kh, []byte(tt.knownHosts+"\n"), 0600); err != nil {
+				t.Fatal(err)
+			}
+			got, err := orderHostKeyAlgorithms([]string{kh}, "example.com:22")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want == "" {
+				if got != nil {
+					t.Errorf("got %v want nil", got)
+				}
+				return
+			}
+			if got[0] != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+			if len(got) != len(defaultHostKeyAlgorithms) {
+				t.Errorf("got %v", got)
+			}
+		})
+	}
+}
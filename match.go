@@ -0,0 +1,369 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/k1LoW/exec"
+	"github.com/kevinburke/ssh_config"
+)
+
+// matchHostPrefix is the prefix of the Host pattern that replaces a Match line while parsing ssh_config.
+const matchHostPrefix = "@sshc-match-"
+
+// pluralKeys are keywords whose values are accumulated instead of the first obtained value being used.
+var pluralKeys = map[string]bool{
+	"certificatefile": true,
+	"identityfile":    true,
+	"localforward":    true,
+	"remoteforward":   true,
+	"dynamicforward":  true,
+	"sendenv":         true,
+	"setenv":          true,
+}
+
+type matchCriterion struct {
+	name   string
+	arg    string
+	negate bool
+}
+
+// match is the criteria of a Match line.
+type match struct {
+	criteria []matchCriterion
+}
+
+type rawValue struct {
+	val  string
+	base string
+	// path and line are the location of the value
+	path string
+	line int
+}
+
+// evaluation is the result of evaluating all ssh_config for a host.
+type evaluation struct {
+	values map[string][]rawValue
+}
+
+// evaluations caches evaluation per host.
+type evaluations struct {
+	mu sync.Mutex
+	m  map[string]*evaluation
+}
+
+type evalState struct {
+	host       string
+	final      bool
+	wantFinal  bool
+	userOpt    string
+	hostOpt    string
+	values     map[string][]rawValue
+	execResult map[string]bool
+}
+
+func newEvaluations() *evaluations {
+	return &evaluations{m: map[string]*evaluation{}}
+}
+
+// parseMatch parses the arguments of a Match line.
+func parseMatch(arg string) (*match, error) {
+	args, err := splitArgs(arg)
+	if err != nil {
+		return nil, err
+	}
+	if len(args) == 0 {
+		return nil, errors.New("Match: missing criteria")
+	}
+	m := &match{}
+	for i := 0; i < len(args); i++ {
+		name := args[i]
+		negate := false
+		if strings.HasPrefix(name, "!") {
+			negate = true
+			name = name[1:]
+		}
+		name = strings.ToLower(name)
+		switch name {
+		case "all":
+			for _, c := range m.criteria {
+				if c.name != "canonical" && c.name != "final" {
+					return nil, errors.New("Match: 'all' cannot be combined with other criteria")
+				}
+			}
+			if i != len(args)-1 {
+				return nil, errors.New("Match: 'all' cannot be combined with other criteria")
+			}
+			m.criteria = append(m.criteria, matchCriterion{name: name, negate: negate})
+		case "canonical", "final":
+			m.criteria = append(m.criteria, matchCriterion{name: name, negate: negate})
+		case "host", "originalhost", "user", "localuser", "exec":
+			if i+1 >= len(args) {
+				return nil, fmt.Errorf("Match: missing argument for %q", name)
+			}
+			i++
+			m.criteria = append(m.criteria, matchCriterion{name: name, arg: args[i], negate: negate})
+		default:
+			return nil, fmt.Errorf("Match: unsupported criteria %q", args[i])
+		}
+	}
+	return m, nil
+}
+
+// evaluate evaluates all ssh_config for host in the same manner as OpenSSH
+// (the first obtained value is used, Match blocks are evaluated in order, and a final pass is done when requested).
+func (c *Config) evaluate(host string) *evaluation {
+	c.evaluations.mu.Lock()
+	defer c.evaluations.mu.Unlock()
+	if ev, ok := c.evaluations.m[host]; ok {
+		return ev
+	}
+	st := &evalState{
+		host:       host,
+		userOpt:    c.user,
+		hostOpt:    c.hostname,
+		values:     map[string][]rawValue{},
+		execResult: map[string]bool{},
+	}
+	for _, sc := range c.sshConfigs {
+		c.walk(sc, filepath.Dir(sc.path), st, false)
+	}
+	if st.wantFinal {
+		st.final = true
+		for _, sc := range c.sshConfigs {
+			c.walk(sc, filepath.Dir(sc.path), st, false)
+		}
+	}
+	ev := &evaluation{values: st.values}
+	c.evaluations.m[host] = ev
+	return ev
+}
+
+func (c *Config) walk(sc *sshConfig, base string, st *evalState, neverMatch bool) {
+	for _, h := range sc.sc.Hosts {
+		active := false
+		if !neverMatch {
+			active = c.hostMatches(h, st)
+		}
+		for _, node := range h.Nodes {
+			kv, ok := node.(*ssh_config.KV)
+			if !ok {
+				continue
+			}
+			key := strings.ToLower(kv.Key)
+			if key == strings.ToLower(includeKey) {
+				idx, err := strconv.Atoi(kv.Value)
+				if err != nil || idx >= len(c.includes) {
+					continue
+				}
+				for _, inc := range c.includes[idx] {
+					c.walk(inc, base, st, !active)
+				}
+				continue
+			}
+			if !active || kv.Value == "" {
+				continue
+			}
+			if _, ok := st.values[key]; ok && !pluralKeys[key] {
+				continue
+			}
+			if containsValue(st.values[key], kv.Value) {
+				// a value obtained in the first pass appears again in the final pass
+				continue
+			}
+			st.values[key] = append(st.values[key], rawValue{val: kv.Value, base: base, path: sc.path, line: kv.Pos().Line})
+		}
+	}
+}
+
+func (c *Config) hostMatches(h *ssh_config.Host, st *evalState) bool {
+	if len(h.Patterns) == 1 && strings.HasPrefix(h.Patterns[0].String(), matchHostPrefix) {
+		idx, err := strconv.Atoi(strings.TrimPrefix(h.Patterns[0].String(), matchHostPrefix))
+		if err != nil || idx >= len(c.matches) {
+			return false
+		}
+		return c.matches[idx].evaluate(st)
+	}
+	return h.Matches(st.host)
+}
+
+func (m *match) evaluate(st *evalState) bool {
+	for _, cr := range m.criteria {
+		// only final requests the final pass, as OpenSSH. canonical matches in it but does not request it
+		if cr.name == "final" && !cr.negate && !st.final {
+			st.wantFinal = true
+		}
+	}
+	for _, cr := range m.criteria {
+		var ok bool
+		switch cr.name {
+		case "all":
+			ok = true
+		case "canonical", "final":
+			ok = st.final
+		case "host":
+			ok = matchPatternList(cr.arg, st.hostname())
+		case "originalhost":
+			ok = matchPatternList(cr.arg, st.host)
+		case "user":
+			ok = matchPatternList(cr.arg, st.user())
+		case "localuser":
+			ok = matchPatternList(cr.arg, localUsername())
+		case "exec":
+			ok = st.exec(cr.arg)
+		}
+		if ok == cr.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// hostname returns the hostname obtained so far.
+func (st *evalState) hostname() string {
+	if st.hostOpt != "" {
+		return st.hostOpt
+	}
+	if v := st.values["hostname"]; len(v) > 0 {
+		t := &tokens{hostname: st.host}
+		if h, err := t.expand(v[0].val, hostnameTokens, false); err == nil {
+			return h
+		}
+		return v[0].val
+	}
+	return st.host
+}
+
+// user returns the remote user obtained so far.
+func (st *evalState) user() string {
+	if st.userOpt != "" {
+		return st.userOpt
+	}
+	if v := st.values["user"]; len(v) > 0 {
+		return v[0].val
+	}
+	return localUsername()
+}
+
+// value returns the value of key obtained so far.
+func (st *evalState) value(key string) string {
+	if v := st.values[key]; len(v) > 0 {
+		return v[0].val
+	}
+	return ""
+}
+
+// port returns the port obtained so far.
+func (st *evalState) port() int {
+	if v := st.values["port"]; len(v) > 0 {
+		if p, err := strconv.Atoi(v[0].val); err == nil {
+			return p
+		}
+	}
+	return 22
+}
+
+// exec runs the command of `Match exec` and reports whether it exits with status 0.
+// If the command has an invalid token, it does not match.
+func (st *evalState) exec(command string) bool {
+	t := &tokens{
+		host:         st.host,
+		hostname:     st.hostname(),
+		user:         st.user(),
+		port:         st.port(),
+		proxyJump:    st.value("proxyjump"),
+		hostKeyAlias: st.value("hostkeyalias"),
+	}
+	command, err := t.expand(command, fileTokens, false)
+	if err != nil {
+		return false
+	}
+	if r, ok := st.execResult[command]; ok {
+		return r
+	}
+	cmd := exec.Command("sh", "-c", command) // #nosec
+	r := cmd.Run() == nil
+	st.execResult[command] = r
+	return r
+}
+
+func containsValue(vals []rawValue, v string) bool {
+	for _, rv := range vals {
+		if rv.val == v {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPatternList reports whether s matches the comma separated pattern list (negated patterns are supported).
+func matchPatternList(list, s string) bool {
+	h := &ssh_config.Host{}
+	for _, p := range strings.Split(list, ",") {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+		pat, err := ssh_config.NewPattern(p)
+		if err != nil {
+			return false
+		}
+		h.Patterns = append(h.Patterns, pat)
+	}
+	return h.Matches(s)
+}
+
+func localUsername() string {
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return os.Getenv("USER")
+}
+
+// splitArgs splits s into arguments separated by whitespace. Double and single quotes group an argument.
+func splitArgs(s string) ([]string, error) {
+	var (
+		args    []string
+		cur     strings.Builder
+		quote   rune
+		inToken bool
+	)
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+				continue
+			}
+			cur.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote = r
+			inToken = true
+		case r == ' ' || r == '\t':
+			if inToken {
+				args = append(args, cur.String())
+				cur.Reset()
+				inToken = false
+			}
+		case r == '#' && !inToken:
+			// trailing comment
+			return args, nil
+		default:
+			cur.WriteRune(r)
+			inToken = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.New("unterminated quoted string")
+	}
+	if inToken {
+		args = append(args, cur.String())
+	}
+	return args, nil
+}
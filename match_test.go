@@ -0,0 +1,179 @@
+package sshc
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMatch(t *testing.T) {
+	data := []byte(`Host web
+  HostName web.example.prod
+
+Match host *.prod user deploy
+  Port 2222
+
+Match originalhost web !user deploy
+  Port 3333
+
+Match exec "exit 1"
+  IdentityFile ~/.ssh/never
+
+Match exec "test %h = web.example.prod"
+  IdentityFile ~/.ssh/id_web
+
+Match host *.staging,!db.* 
+  User stg
+
+Match final host *.prod
+  ServerAliveInterval 10
+  ProxyJump bastion.prod
+
+Match final
+  User final
+
+Match all
+  ProxyJump all
+  ConnectTimeout 5
+`)
+	tests := []struct {
+		host string
+		opts []Option
+		key  string
+		want string
+	}{
+		{"web", []Option{User("deploy")}, "Port", "2222"},
+		{"web", []Option{User("alice")}, "Port", "3333"},
+		{"web", nil, "IdentityFile", "~/.ssh/id_web"},
+		{"web", nil, "ServerAliveInterval", "10"},
+		{"web", nil, "ProxyJump", "all"},
+		{"app.staging", nil, "ServerAliveInterval", "0"},
+		{"web", nil, "User", "final"},
+		{"app.staging", nil, "User", "stg"},
+		{"db.staging", nil, "User", "final"},
+		{"app.staging", nil, "ProxyJump", "all"},
+		{"app.staging", nil, "ConnectTimeout", "5"},
+		{"app.staging", nil, "Port", "22"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.host+"/"+tt.key, func(t *testing.T) {
+			opts := append([]Option{ClearConfig(), ConfigData(data)}, tt.opts...)
+			c, err := NewConfig(opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Get(tt.host, tt.key); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchCanonical(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		key  string
+		want string
+	}{
+		{"canonical does not request the final pass", "Match canonical\n  User canon\n", "User", ""},
+		{"negated final does not request the final pass", "Match !final\n  User notfinal\nMatch canonical\n  Port 2022\n", "Port", "22"},
+		{"negated final matches without the final pass", "Match !final\n  User notfinal\n", "User", "notfinal"},
+		{"canonical matches in the final pass", "Match canonical\n  User canon\nMatch final\n  Port 2022\n", "User", "canon"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := NewConfig(ClearConfig(), ConfigData([]byte(tt.data)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := c.Get("foo", tt.key); got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchLocalUser(t *testing.T) {
+	data := []byte(`Match localuser ` + localUsername() + `
+  User me
+`)
+	c, err := NewConfig(ClearConfig(), ConfigData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := c.Get("any", "User"), "me"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestMatchInInclude(t *testing.T) {
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	if err := os.MkdirAll(filepath.Join(home, ".ssh"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	files := map[string]string{
+		"config": `Include outer
+
+Host app
+  Include inner
+`,
+		"inner": `User inner
+Match host app
+  Port 2022
+`,
+		"outer": `Match originalhost other
+  Port 3022
+`,
+	}
+	for n, content := range files {
+		if err := os.WriteFile(filepath.Join(home, ".ssh", n), []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c, err := NewConfig(ClearConfig(), ConfigPath(filepath.Join(home, ".ssh", "config")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host string
+		key  string
+		want string
+	}{
+		{"app", "User", "inner"},
+		{"app", "Port", "2022"},
+		{"other", "User", ""},
+		{"other", "Port", "3022"},
+	}
+	for _, tt := range tests {
+		if got := c.Get(tt.host, tt.key); got != tt.want {
+			t.Errorf("%s %s: got %v want %v", tt.host, tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestParseMatch(t *testing.T) {
+	tests := []struct {
+		in      string
+		wantErr bool
+	}{
+		{"host a,b user c", false},
+		{"all", false},
+		{"canonical all", false},
+		{`exec "test -f /tmp/x"`, false},
+		{"host", true},
+		{"all host a", true},
+		{"host a all", true},
+		{"unknown a", true},
+		{`exec "unterminated`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			_, err := parseMatch(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,393 @@
+package sshc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// defaultPoolMaxSessions is the default of MaxSessions of sshd.
+	defaultPoolMaxSessions       = 10
+	defaultPoolIdleTimeout       = 5 * time.Minute
+	defaultPoolKeepaliveInterval = 30 * time.Second
+	// poolMaxAttempts is the number of tries to open a session when the connection turns out to be broken or full.
+	poolMaxAttempts  = 3
+	keepaliveRequest = "keepalive@openssh.com"
+)
+
+// ErrPoolClosed is the error returned by Pool after Close is called.
+var ErrPoolClosed = errors.New("pool is closed")
+
+// Pool shares *ssh.Client among sessions to the same host.
+// Clients are keyed by the resolved user, hostname, port, ProxyCommand and ProxyJump,
+// checked with keepalive requests, reconnected when broken and closed when idle.
+type Pool struct {
+	config            *Config
+	options           []Option
+	maxSessions       int
+	idleTimeout       time.Duration
+	keepaliveInterval time.Duration
+
+	mu      sync.Mutex
+	clients map[poolKey][]*pooledClient
+	dials   map[poolKey]*poolDial
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
+}
+
+// PoolOption is the option of NewPool.
+type PoolOption func(*Pool) error
+
+// PoolSession is *ssh.Session of a client in Pool. Close releases the session from the client.
+type PoolSession struct {
+	*ssh.Session
+	release func()
+}
+
+type poolKey struct {
+	user         string
+	hostname     string
+	port         int
+	proxyCommand string
+	proxyJump    string
+}
+
+// poolDial is a dial in flight for a key, which the other sessions for the key wait for.
+type poolDial struct {
+	done chan struct{}
+	err  error
+}
+
+type pooledClient struct {
+	client *ssh.Client
+	// maxSessions is lowered when the server refuses a session before the limit of Pool
+	maxSessions int
+	sessions    int
+	lastUsed    time.Time
+	broken      bool
+}
+
+// NewPool returns *Pool. The ssh_config is read once when NewPool is called.
+func NewPool(options ...PoolOption) (*Pool, error) {
+	p := &Pool{
+		maxSessions:       defaultPoolMaxSessions,
+		idleTimeout:       defaultPoolIdleTimeout,
+		keepaliveInterval: defaultPoolKeepaliveInterval,
+		clients:           map[poolKey][]*pooledClient{},
+		dials:             map[poolKey]*poolDial{},
+		done:              make(chan struct{}),
+	}
+	for _, opt := range options {
+		if err := opt(p); err != nil {
+			return nil, err
+		}
+	}
+	c, err := NewConfig(p.options...)
+	if err != nil {
+		return nil, err
+	}
+	p.config = c
+	p.wg.Add(1)
+	go p.maintain()
+	return p, nil
+}
+
+// PoolClientOptions returns PoolOption that set the Options to create clients.
+func PoolClientOptions(options ...Option) PoolOption {
+	return func(p *Pool) error {
+		p.options = append(p.options, options...)
+		return nil
+	}
+}
+
+// PoolMaxSessions returns PoolOption that set the maximum number of sessions per client ( default is 10, same as MaxSessions of sshd ).
+// If the server refuses a session before the limit, the limit of the client is lowered.
+func PoolMaxSessions(n int) PoolOption {
+	return func(p *Pool) error {
+		if n <= 0 {
+			return fmt.Errorf("PoolMaxSessions must be greater than 0, got %d", n)
+		}
+		p.maxSessions = n
+		return nil
+	}
+}
+
+// PoolIdleTimeout returns PoolOption that set the time after which a client without sessions is closed ( default is 5 minutes ).
+func PoolIdleTimeout(d time.Duration) PoolOption {
+	return func(p *Pool) error {
+		if d <= 0 {
+			return fmt.Errorf("PoolIdleTimeout must be greater than 0, got %v", d)
+		}
+		p.idleTimeout = d
+		return nil
+	}
+}
+
+// PoolKeepaliveInterval returns PoolOption that set the interval of keepalive requests to check clients ( default is 30 seconds ).
+// A client that does not answer within the interval is closed.
+func PoolKeepaliveInterval(d time.Duration) PoolOption {
+	return func(p *Pool) error {
+		if d <= 0 {
+			return fmt.Errorf("PoolKeepaliveInterval must be greater than 0, got %v", d)
+		}
+		p.keepaliveInterval = d
+		return nil
+	}
+}
+
+// NewSession returns a new session to host on a client of the pool.
+// A client is created if no client for host has room for the session.
+func (p *Pool) NewSession(ctx context.Context, host string) (*PoolSession, error) {
+	r, err := p.config.Resolve(host)
+	if err != nil {
+		return nil, err
+	}
+	key := poolKey{
+		user:         r.User,
+		hostname:     r.Hostname,
+		port:         r.Port,
+		proxyCommand: r.ProxyCommand,
+		proxyJump:    r.ProxyJump,
+	}
+	for attempt := 1; ; attempt++ {
+		pc, err := p.acquire(ctx, key, r)
+		if err != nil {
+			return nil, err
+		}
+		s, err := pc.client.NewSession()
+		if err == nil {
+			var once sync.Once
+			return &PoolSession{Session: s, release: func() {
+				once.Do(func() {
+					p.release(pc)
+				})
+			}}, nil
+		}
+		var openErr *ssh.OpenChannelError
+		p.mu.Lock()
+		switch {
+		case sessionLimitReached(err):
+			// the server has its own limit ( MaxSessions of sshd )
+			pc.maxSessions = max(pc.sessions-1, 1)
+		case errors.As(err, &openErr):
+			// the client is alive but the session is refused for another reason
+		default:
+			pc.broken = true
+		}
+		p.mu.Unlock()
+		p.release(pc)
+		if attempt >= poolMaxAttempts || ctx.Err() != nil {
+			return nil, err
+		}
+	}
+}
+
+// Close closes all clients of the pool. Sessions of the clients are also closed.
+func (p *Pool) Close() error {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil
+	}
+	p.closed = true
+	clients := p.clients
+	p.clients = map[poolKey][]*pooledClient{}
+	p.mu.Unlock()
+	close(p.done)
+	p.wg.Wait()
+	var errs []error
+	for _, pcs := range clients {
+		for _, pc := range pcs {
+			if err := pc.client.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Close closes the session and releases it from the client of the pool.
+func (s *PoolSession) Close() error {
+	defer s.release()
+	return s.Session.Close()
+}
+
+// acquire returns a client for key with room for a session, creating a client if there is none.
+// While a client for key is being created, the other sessions for key wait for it instead of creating their own.
+func (p *Pool) acquire(ctx context.Context, key poolKey, r *ResolvedHost) (*pooledClient, error) {
+	p.mu.Lock()
+	for {
+		if p.closed {
+			p.mu.Unlock()
+			return nil, ErrPoolClosed
+		}
+		for _, pc := range p.clients[key] {
+			if !pc.broken && pc.sessions < pc.maxSessions {
+				pc.sessions++
+				pc.lastUsed = time.Now()
+				p.mu.Unlock()
+				return pc, nil
+			}
+		}
+		d, ok := p.dials[key]
+		if !ok {
+			break
+		}
+		p.mu.Unlock()
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-d.done:
+		}
+		if d.err != nil && !errors.Is(d.err, context.Canceled) && !errors.Is(d.err, context.DeadlineExceeded) {
+			return nil, d.err
+		}
+		// the new client may have room, or the dial was canceled by its caller
+		p.mu.Lock()
+	}
+	d := &poolDial{done: make(chan struct{})}
+	p.dials[key] = d
+	p.mu.Unlock()
+
+	client, err := p.dial(ctx, r)
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.dials, key)
+	d.err = err
+	close(d.done)
+	if err != nil {
+		return nil, err
+	}
+	if p.closed {
+		_ = client.Close()
+		return nil, ErrPoolClosed
+	}
+	pc := &pooledClient{
+		client:      client,
+		maxSessions: p.maxSessions,
+		sessions:    1,
+		lastUsed:    time.Now(),
+	}
+	p.clients[key] = append(p.clients[key], pc)
+	go func() {
+		_ = client.Wait()
+		p.mu.Lock()
+		pc.broken = true
+		p.mu.Unlock()
+	}()
+	return pc, nil
+}
+
+func (p *Pool) dial(ctx context.Context, r *ResolvedHost) (*ssh.Client, error) {
+	dc, err := p.config.DialConfig(r)
+	if err != nil {
+		return nil, err
+	}
+	return DialContext(ctx, dc)
+}
+
+func (p *Pool) release(pc *pooledClient) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	pc.sessions--
+	pc.lastUsed = time.Now()
+}
+
+// maintain checks the clients every keepalive interval until the pool is closed.
+func (p *Pool) maintain() {
+	defer p.wg.Done()
+	t := time.NewTicker(p.keepaliveInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-p.done:
+			return
+		case <-t.C:
+			p.check()
+		}
+	}
+}
+
+// check removes broken clients and idle clients, and sends keepalive requests to the others.
+func (p *Pool) check() {
+	var (
+		closing []*pooledClient
+		alive   []*pooledClient
+	)
+	now := time.Now()
+	p.mu.Lock()
+	for key, pcs := range p.clients {
+		var kept []*pooledClient
+		for _, pc := range pcs {
+			switch {
+			case pc.broken && pc.sessions == 0,
+				pc.sessions == 0 && now.Sub(pc.lastUsed) >= p.idleTimeout:
+				closing = append(closing, pc)
+			case pc.broken:
+				// wait for the sessions to be released
+				kept = append(kept, pc)
+			default:
+				kept = append(kept, pc)
+				alive = append(alive, pc)
+			}
+		}
+		if len(kept) == 0 {
+			delete(p.clients, key)
+			continue
+		}
+		p.clients[key] = kept
+	}
+	p.mu.Unlock()
+
+	for _, pc := range closing {
+		_ = pc.client.Close()
+	}
+	var wg sync.WaitGroup
+	for _, pc := range alive {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := keepalive(pc.client, p.keepaliveInterval); err != nil {
+				p.mu.Lock()
+				pc.broken = true
+				p.mu.Unlock()
+				_ = pc.client.Close()
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// sessionLimitReached reports whether err is the refusal of a session because the client has too many sessions.
+func sessionLimitReached(err error) bool {
+	var openErr *ssh.OpenChannelError
+	if !errors.As(err, &openErr) {
+		return false
+	}
+	return openErr.Reason == ssh.Prohibited || openErr.Reason == ssh.ResourceShortage
+}
+
+// keepalive sends a keepalive request to the server and waits for the reply up to timeout.
+// The server may refuse the request. Any reply means the connection is alive.
+func keepalive(client *ssh.Client, timeout time.Duration) error {
+	errc := make(chan error, 1)
+	go func() {
+		_, _, err := client.SendRequest(keepaliveRequest, true, nil)
+		errc <- err
+	}()
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case err := <-errc:
+		return err
+	case <-t.C:
+		return errors.New("keepalive timeout")
+	}
+}
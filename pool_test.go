@@ -0,0 +1,213 @@
+package sshc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+func TestPool(t *testing.T) {
+	newPool := func(t *testing.T, srv *testServer, opts ...PoolOption) *Pool {
+		t.Helper()
+		t.Setenv("HOME", t.TempDir())
+		opts = append([]PoolOption{PoolClientOptions(append(srv.optionsWithKey(t, ""), InsecureIgnoreHostKey())...)}, opts...)
+		p, err := NewPool(opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = p.Close()
+		})
+		return p
+	}
+	connections := func(srv *testServer) int {
+		srv.mu.Lock()
+		defer srv.mu.Unlock()
+		return len(srv.users)
+	}
+	run := func(t *testing.T, s *PoolSession) {
+		t.Helper()
+		defer s.Close()
+		out, err := s.Output("hostname")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := strings.TrimSpace(string(out)), "server"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+	}
+
+	t.Run("clients are shared by the resolved host", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv)
+		for _, host := range []string{"server", "alias", "server"} {
+			s, err := p.NewSession(context.Background(), host)
+			if err != nil {
+				t.Fatal(err)
+			}
+			run(t, s)
+		}
+		if got, want := connections(srv), 1; got != want {
+			t.Errorf("got %v connections want %v", got, want)
+		}
+	})
+
+	t.Run("PoolMaxSessions", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv, PoolMaxSessions(2))
+		var sessions []*PoolSession
+		for range 3 {
+			s, err := p.NewSession(context.Background(), "server")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions = append(sessions, s)
+		}
+		if got, want := connections(srv), 2; got != want {
+			t.Errorf("got %v connections want %v", got, want)
+		}
+		for _, s := range sessions {
+			run(t, s)
+		}
+	})
+
+	t.Run("MaxSessions of the server", func(t *testing.T) {
+		srv := newTestServer(t, "server", withMaxSessions(1))
+		p := newPool(t, srv)
+		var sessions []*PoolSession
+		for range 2 {
+			s, err := p.NewSession(context.Background(), "server")
+			if err != nil {
+				t.Fatal(err)
+			}
+			sessions = append(sessions, s)
+		}
+		if got, want := connections(srv), 2; got != want {
+			t.Errorf("got %v connections want %v", got, want)
+		}
+		for _, s := range sessions {
+			run(t, s)
+		}
+	})
+
+	t.Run("concurrent sessions share the dial", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv)
+		var (
+			wg       sync.WaitGroup
+			mu       sync.Mutex
+			sessions []*PoolSession
+		)
+		for range 5 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				s, err := p.NewSession(context.Background(), "server")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				mu.Lock()
+				sessions = append(sessions, s)
+				mu.Unlock()
+			}()
+		}
+		wg.Wait()
+		if got, want := connections(srv), 1; got != want {
+			t.Errorf("got %v connections want %v", got, want)
+		}
+		for _, s := range sessions {
+			run(t, s)
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv)
+		s, err := p.NewSession(context.Background(), "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(t, s)
+		p.mu.Lock()
+		for _, pcs := range p.clients {
+			for _, pc := range pcs {
+				_ = pc.client.Close()
+			}
+		}
+		p.mu.Unlock()
+		s, err = p.NewSession(context.Background(), "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(t, s)
+		if got, want := connections(srv), 2; got != want {
+			t.Errorf("got %v connections want %v", got, want)
+		}
+	})
+
+	t.Run("PoolIdleTimeout", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv, PoolIdleTimeout(50*time.Millisecond), PoolKeepaliveInterval(10*time.Millisecond))
+		s, err := p.NewSession(context.Background(), "server")
+		if err != nil {
+			t.Fatal(err)
+		}
+		run(t, s)
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			p.mu.Lock()
+			n := len(p.clients)
+			p.mu.Unlock()
+			if n == 0 {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatal("idle client should be closed")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})
+
+	t.Run("Close", func(t *testing.T) {
+		srv := newTestServer(t, "server")
+		p := newPool(t, srv)
+		if err := p.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := p.NewSession(context.Background(), "server"); !errors.Is(err, ErrPoolClosed) {
+			t.Errorf("got %v want %v", err, ErrPoolClosed)
+		}
+	})
+
+	t.Run("invalid option", func(t *testing.T) {
+		if _, err := NewPool(PoolMaxSessions(0)); err == nil {
+			t.Error("want error")
+		}
+	})
+}
+
+func TestSessionLimitReached(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&ssh.OpenChannelError{Reason: ssh.Prohibited}, true},
+		{&ssh.OpenChannelError{Reason: ssh.ResourceShortage}, true},
+		{fmt.Errorf("session: %w", &ssh.OpenChannelError{Reason: ssh.Prohibited}), true},
+		{&ssh.OpenChannelError{Reason: ssh.ConnectionFailed}, false},
+		{&ssh.OpenChannelError{Reason: ssh.UnknownChannelType}, false},
+		{errors.New("EOF"), false},
+	}
+	for _, tt := range tests {
+		if got := sessionLimitReached(tt.err); got != tt.want {
+			t.Errorf("%v: got %v want %v", tt.err, got, tt.want)
+		}
+	}
+}
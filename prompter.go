@@ -0,0 +1,204 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/term"
+)
+
+// ErrPromptNotAllowed is the error returned by NonInteractivePrompter.
+var ErrPromptNotAllowed = errors.New("prompt is not allowed in batch mode")
+
+// ErrNoTerminal is the error returned by TerminalPrompter when there is no controlling terminal.
+var ErrNoTerminal = errors.New("no controlling terminal to prompt")
+
+// Prompter asks the user for secrets and confirmations while connecting.
+type Prompter interface {
+	// PassphrasePrompt returns the passphrase for the private key of keyPath.
+	// keyPath is empty when the key is given as bytes.
+	PassphrasePrompt(keyPath string) ([]byte, error)
+	// PasswordPrompt returns the password of user at host.
+	PasswordPrompt(user, host string) (string, error)
+	// KeyboardInteractive answers the questions of a keyboard-interactive challenge ( see ssh.KeyboardInteractiveChallenge ).
+	KeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error)
+	// HostKeyPrompt reports whether the user accepts key of the unknown host when StrictHostKeyChecking is ask.
+	// hostname is the name looked up in known_hosts and remote is the address of the host.
+	HostKeyPrompt(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error)
+}
+
+// TerminalPrompter is the Prompter that reads from the controlling terminal and writes prompts to stderr.
+// It never reads from stdin. If there is no controlling terminal, ErrNoTerminal is returned.
+type TerminalPrompter struct{}
+
+// NonInteractivePrompter is the Prompter that never prompts and returns ErrPromptNotAllowed.
+type NonInteractivePrompter struct{}
+
+// PassphrasePrompt reads the passphrase for the private key of keyPath from the terminal.
+func (p TerminalPrompter) PassphrasePrompt(keyPath string) ([]byte, error) {
+	if keyPath == "" {
+		return p.readSecret("Enter passphrase for key: ")
+	}
+	return p.readSecret(fmt.Sprintf("Enter passphrase for key '%s': ", keyPath))
+}
+
+// PasswordPrompt reads the password of user at host from the terminal.
+func (p TerminalPrompter) PasswordPrompt(user, host string) (string, error) {
+	b, err := p.readSecret(fmt.Sprintf("%s@%s's password: ", user, host))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// KeyboardInteractive reads the answers of the questions from the terminal.
+// Answers of the questions with echo enabled are read as plain lines.
+func (p TerminalPrompter) KeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if name != "" {
+		_, _ = fmt.Fprintln(os.Stderr, name)
+	}
+	if instruction != "" {
+		_, _ = fmt.Fprintln(os.Stderr, instruction)
+	}
+	answers := make([]string, len(questions))
+	for i, q := range questions {
+		if i < len(echos) && echos[i] {
+			a, err := p.readLine(q)
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = a
+			continue
+		}
+		b, err := p.readSecret(q)
+		if err != nil {
+			return nil, err
+		}
+		answers[i] = string(b)
+	}
+	return answers, nil
+}
+
+// HostKeyPrompt shows the fingerprint of key and asks the user on the terminal to continue connecting, like OpenSSH.
+// The answer is yes, no or the fingerprint of key.
+func (p TerminalPrompter) HostKeyPrompt(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	fp := ssh.FingerprintSHA256(key)
+	host := hostname
+	if remote != nil && remote.String() != hostname {
+		host = fmt.Sprintf("%s (%s)", hostname, remote)
+	}
+	_, _ = fmt.Fprintf(os.Stderr, "The authenticity of host '%s' can't be established.\n%s key fingerprint is %s.\n", host, key.Type(), fp)
+	prompt := "Are you sure you want to continue connecting (yes/no/[fingerprint])? "
+	for {
+		a, err := p.readLine(prompt)
+		if err != nil {
+			return false, err
+		}
+		switch a = strings.TrimSpace(a); {
+		case strings.EqualFold(a, "yes"), a == fp:
+			return true, nil
+		case strings.EqualFold(a, "no"):
+			return false, nil
+		}
+		prompt = "Please type 'yes', 'no' or the fingerprint: "
+	}
+}
+
+func (p TerminalPrompter) readSecret(prompt string) ([]byte, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return nil, err
+	}
+	defer tty.Close()
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	b, err := term.ReadPassword(int(tty.Fd())) // #nosec
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// readLine reads a line from the terminal a byte at a time so that nothing after the line is consumed.
+func (p TerminalPrompter) readLine(prompt string) (string, error) {
+	tty, err := openTTY()
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	var (
+		l []byte
+		b = make([]byte, 1)
+	)
+	for {
+		n, err := tty.Read(b)
+		if n > 0 {
+			if b[0] == '\n' {
+				break
+			}
+			l = append(l, b[0])
+		}
+		if err != nil {
+			if errors.Is(err, io.EOF) && len(l) > 0 {
+				break
+			}
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(l), "\r"), nil
+}
+
+// openTTY opens the controlling terminal. If it cannot be opened, ErrNoTerminal is returned instead of falling back to stdin.
+func openTTY() (*os.File, error) {
+	tty, err := os.OpenFile(ttyName, os.O_RDWR, 0)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrNoTerminal, err)
+	}
+	if !term.IsTerminal(int(tty.Fd())) { // #nosec
+		_ = tty.Close()
+		return nil, fmt.Errorf("%w: %s is not a terminal", ErrNoTerminal, ttyName)
+	}
+	return tty, nil
+}
+
+// PassphrasePrompt returns ErrPromptNotAllowed.
+func (p NonInteractivePrompter) PassphrasePrompt(keyPath string) ([]byte, error) {
+	if keyPath == "" {
+		return nil, fmt.Errorf("%w: passphrase for key", ErrPromptNotAllowed)
+	}
+	return nil, fmt.Errorf("%w: passphrase for key %s", ErrPromptNotAllowed, keyPath)
+}
+
+// PasswordPrompt returns ErrPromptNotAllowed.
+func (p NonInteractivePrompter) PasswordPrompt(user, host string) (string, error) {
+	return "", fmt.Errorf("%w: password for %s@%s", ErrPromptNotAllowed, user, host)
+}
+
+// KeyboardInteractive returns ErrPromptNotAllowed unless there are no questions.
+func (p NonInteractivePrompter) KeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) == 0 {
+		return []string{}, nil
+	}
+	return nil, fmt.Errorf("%w: keyboard-interactive", ErrPromptNotAllowed)
+}
+
+// HostKeyPrompt returns ErrPromptNotAllowed.
+func (p NonInteractivePrompter) HostKeyPrompt(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	return false, fmt.Errorf("%w: host key for %s", ErrPromptNotAllowed, hostname)
+}
+
+// staticAnswers returns ssh.KeyboardInteractiveChallenge that answers the questions with answers in order.
+func staticAnswers(answers []string) ssh.KeyboardInteractiveChallenge {
+	return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		if len(questions) > len(answers) {
+			return nil, fmt.Errorf("keyboard-interactive: %d questions asked but %d answers given", len(questions), len(answers))
+		}
+		return append([]string{}, answers[:len(questions)]...), nil
+	}
+}
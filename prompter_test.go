@@ -0,0 +1,195 @@
+package sshc
+
+import (
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+type testPrompter struct {
+	passphrase  []byte
+	password    string
+	passphrases []string
+	passwords   []string
+	acceptKey   bool
+	hostKeys    []string
+}
+
+func (p *testPrompter) PassphrasePrompt(keyPath string) ([]byte, error) {
+	p.passphrases = append(p.passphrases, keyPath)
+	return p.passphrase, nil
+}
+
+func (p *testPrompter) PasswordPrompt(user, host string) (string, error) {
+	p.passwords = append(p.passwords, fmt.Sprintf("%s@%s", user, host))
+	return p.password, nil
+}
+
+func (p *testPrompter) KeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	return nil, errors.New("unexpected keyboard-interactive")
+}
+
+func (p *testPrompter) HostKeyPrompt(hostname string, remote net.Addr, key ssh.PublicKey) (bool, error) {
+	p.hostKeys = append(p.hostKeys, hostname)
+	return p.acceptKey, nil
+}
+
+func TestPrompter(t *testing.T) {
+	srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+		c.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if string(password) == "pass" {
+				return nil, nil
+			}
+			return nil, errTestUnauthorized
+		}
+	}))
+	encrypted := writeEncryptedKey(t, []byte("secret"))
+
+	tests := []struct {
+		name            string
+		config          string
+		prompter        *testPrompter
+		wantErr         error
+		wantPassphrases int
+		wantPasswords   int
+	}{
+		{"passphrase", fmt.Sprintf("  IdentityFile %s\n", encrypted), &testPrompter{passphrase: []byte("secret")}, nil, 1, 0},
+		{"password", "  IdentityFile none\n", &testPrompter{password: "pass"}, nil, 0, 1},
+		{"batch mode passphrase", fmt.Sprintf("  IdentityFile %s\n  BatchMode yes\n", encrypted), &testPrompter{passphrase: []byte("secret")}, ErrPromptNotAllowed, 0, 0},
+		{"batch mode password", "  IdentityFile none\n  BatchMode yes\n", &testPrompter{password: "pass"}, &AuthFailedError{}, 0, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			opts := append(srv.options("  User alice\n"+tt.config), InsecureIgnoreHostKey(), UsePrompter(tt.prompter))
+			client, err := NewClient("server", opts...)
+			switch want := tt.wantErr.(type) {
+			case nil:
+				if err != nil {
+					t.Fatal(err)
+				}
+				_ = client.Close()
+			case *AuthFailedError:
+				if !errors.As(err, &want) {
+					t.Fatalf("got %v", err)
+				}
+			default:
+				if !errors.Is(err, want) {
+					t.Fatalf("got %v want %v", err, want)
+				}
+			}
+			if got := len(tt.prompter.passphrases); got != tt.wantPassphrases {
+				t.Errorf("got %v want %v", got, tt.wantPassphrases)
+			}
+			if got := len(tt.prompter.passwords); got != tt.wantPasswords {
+				t.Errorf("got %v want %v", got, tt.wantPasswords)
+			}
+		})
+	}
+}
+
+func TestNonInteractivePrompter(t *testing.T) {
+	p := NonInteractivePrompter{}
+	if _, err := p.PassphrasePrompt("/path/to/key"); !errors.Is(err, ErrPromptNotAllowed) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := p.PasswordPrompt("alice", "example.com"); !errors.Is(err, ErrPromptNotAllowed) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := p.KeyboardInteractive("", "", []string{"Password: "}, []bool{false}); !errors.Is(err, ErrPromptNotAllowed) {
+		t.Errorf("got %v", err)
+	}
+	if _, err := p.KeyboardInteractive("", "", nil, nil); err != nil {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestTerminalPrompterWithoutTerminal(t *testing.T) {
+	b, err := os.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.ParsePrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	notTerminal := filepath.Join(t.TempDir(), "tty")
+	if err := os.WriteFile(notTerminal, []byte("yes\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{filepath.Join(t.TempDir(), "missing"), notTerminal} {
+		t.Run(filepath.Base(name), func(t *testing.T) {
+			orig := ttyName
+			ttyName = name
+			t.Cleanup(func() {
+				ttyName = orig
+			})
+			r, w, err := os.Pipe()
+			if err != nil {
+				t.Fatal(err)
+			}
+			stdin := os.Stdin
+			os.Stdin = r
+			t.Cleanup(func() {
+				os.Stdin = stdin
+				_ = r.Close()
+			})
+			const input = "yes\nimportant-data\n"
+			if _, err := w.WriteString(input); err != nil {
+				t.Fatal(err)
+			}
+			_ = w.Close()
+
+			p := TerminalPrompter{}
+			ok, err := p.HostKeyPrompt("example.com", nil, signer.PublicKey())
+			if !errors.Is(err, ErrNoTerminal) {
+				t.Errorf("got %v want %v", err, ErrNoTerminal)
+			}
+			if ok {
+				t.Error("host key should not be accepted")
+			}
+			if _, err := p.PassphrasePrompt("/path/to/key"); !errors.Is(err, ErrNoTerminal) {
+				t.Errorf("got %v want %v", err, ErrNoTerminal)
+			}
+			if _, err := p.KeyboardInteractive("", "", []string{"Code: "}, []bool{true}); !errors.Is(err, ErrNoTerminal) {
+				t.Errorf("got %v want %v", err, ErrNoTerminal)
+			}
+			b, err := io.ReadAll(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := string(b); got != input {
+				t.Errorf("stdin should not be read: got %q want %q", got, input)
+			}
+		})
+	}
+}
+
+// writeEncryptedKey writes testdata/id_rsa encrypted with passphrase and returns the path.
+func writeEncryptedKey(t *testing.T, passphrase []byte) string {
+	t.Helper()
+	b, err := os.ReadFile("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := ssh.ParseRawPrivateKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := ssh.MarshalPrivateKeyWithPassphrase(key, "", passphrase)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := filepath.Join(t.TempDir(), "id_rsa_encrypted")
+	if err := os.WriteFile(p, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
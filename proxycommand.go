@@ -0,0 +1,183 @@
+package sshc
+
+import (
+	"io"
+	"net"
+	"os"
+	osexec "os/exec"
+	"sync"
+	"time"
+
+	"github.com/k1LoW/exec"
+)
+
+const (
+	// proxyCommandStderrSize is the maximum size of the standard error output of ProxyCommand kept for ProxyCommandError.
+	proxyCommandStderrSize = 64 * 1024
+	// proxyCommandWaitDelay bounds the wait for the I/O of ProxyCommand after the process exits.
+	proxyCommandWaitDelay = time.Second
+)
+
+// proxyCommandConn is net.Conn connected to the standard input and output of ProxyCommand.
+// Closing it kills the process and waits for it.
+type proxyCommandConn struct {
+	command string
+	cmd     *osexec.Cmd
+	r       *os.File
+	w       *os.File
+	stderr  *tailBuffer
+
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// startProxyCommand starts command with `sh -c` in dir. The standard error output of the command is written to stderr.
+func startProxyCommand(command, dir string, stderr io.Writer) (*proxyCommandConn, error) {
+	stdinR, stdinW, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	stdoutR, stdoutW, err := os.Pipe()
+	if err != nil {
+		_ = stdinR.Close()
+		_ = stdinW.Close()
+		return nil, err
+	}
+	tail := &tailBuffer{max: proxyCommandStderrSize}
+	cmd := exec.Command("sh", "-c", command) // #nosec
+	cmd.Dir = dir
+	cmd.Stdin = stdinR
+	cmd.Stdout = stdoutW
+	cmd.Stderr = &teeWriter{w: stderr, buf: tail}
+	cmd.WaitDelay = proxyCommandWaitDelay
+	if err := cmd.Start(); err != nil {
+		for _, f := range []*os.File{stdinR, stdinW, stdoutR, stdoutW} {
+			_ = f.Close()
+		}
+		return nil, &ProxyCommandError{Command: command, ExitCode: -1, Err: err}
+	}
+	// The child process has its own copies
+	_ = stdinR.Close()
+	_ = stdoutW.Close()
+
+	c := &proxyCommandConn{
+		command: command,
+		cmd:     cmd,
+		r:       stdoutR,
+		w:       stdinW,
+		stderr:  tail,
+		done:    make(chan struct{}),
+	}
+	go func() {
+		_ = cmd.Wait()
+		close(c.done)
+	}()
+	return c, nil
+}
+
+func (c *proxyCommandConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *proxyCommandConn) Write(b []byte) (int, error) {
+	return c.w.Write(b)
+}
+
+// Close closes the pipes, kills ProxyCommand if it is still running and waits for it to exit.
+func (c *proxyCommandConn) Close() error {
+	c.closeOnce.Do(func() {
+		_ = c.w.Close()
+		_ = c.r.Close()
+		select {
+		case <-c.done:
+		default:
+			_ = exec.KillCommand(c.cmd)
+			<-c.done
+		}
+	})
+	return nil
+}
+
+func (c *proxyCommandConn) LocalAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+func (c *proxyCommandConn) RemoteAddr() net.Addr {
+	return proxyCommandAddr{}
+}
+
+func (c *proxyCommandConn) SetDeadline(t time.Time) error {
+	if err := c.r.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return c.w.SetWriteDeadline(t)
+}
+
+func (c *proxyCommandConn) SetReadDeadline(t time.Time) error {
+	return c.r.SetReadDeadline(t)
+}
+
+func (c *proxyCommandConn) SetWriteDeadline(t time.Time) error {
+	return c.w.SetWriteDeadline(t)
+}
+
+// error returns *ProxyCommandError wrapping err. It must be called after Close.
+func (c *proxyCommandConn) error(err error) *ProxyCommandError {
+	code := -1
+	if c.cmd.ProcessState != nil {
+		code = c.cmd.ProcessState.ExitCode()
+	}
+	return &ProxyCommandError{
+		Command:  c.command,
+		ExitCode: code,
+		Stderr:   c.stderr.Bytes(),
+		Err:      err,
+	}
+}
+
+type proxyCommandAddr struct{}
+
+func (proxyCommandAddr) Network() string {
+	return "proxycommand"
+}
+
+func (proxyCommandAddr) String() string {
+	return "proxycommand"
+}
+
+// tailBuffer keeps the last max bytes written.
+type tailBuffer struct {
+	mu  sync.Mutex
+	buf []byte
+	max int
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) Bytes() []byte {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return append([]byte(nil), b.buf...)
+}
+
+// teeWriter writes to w and buf. Errors from w are ignored so that the output is always kept in buf.
+type teeWriter struct {
+	w   io.Writer
+	buf *tailBuffer
+}
+
+func (t *teeWriter) Write(p []byte) (int, error) {
+	_, _ = t.buf.Write(p)
+	if t.w != nil {
+		_, _ = t.w.Write(p)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,190 @@
+package sshc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// jumpSpec is a host of ProxyJump ( [user@]host[:port] ).
+type jumpSpec struct {
+	user string
+	host string
+	port int
+}
+
+// parseProxyJump parses the comma separated ProxyJump value.
+func parseProxyJump(text string) ([]jumpSpec, error) {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.EqualFold(text, "none") {
+		return nil, nil
+	}
+	var specs []jumpSpec
+	for _, h := range strings.Split(text, ",") {
+		h = strings.TrimPrefix(strings.TrimSpace(h), "ssh://")
+		s := jumpSpec{}
+		if i := strings.LastIndex(h, "@"); i >= 0 {
+			s.user = h[:i]
+			h = h[i+1:]
+		}
+		port := ""
+		switch {
+		case strings.HasPrefix(h, "["):
+			host, p, err := net.SplitHostPort(h)
+			if err != nil {
+				if !strings.HasSuffix(h, "]") {
+					return nil, errors.New("proxyJump is wrong format")
+				}
+				host = strings.Trim(h, "[]")
+			}
+			h, port = host, p
+		case strings.Count(h, ":") == 1:
+			i := strings.Index(h, ":")
+			h, port = h[:i], h[i+1:]
+		}
+		if h == "" {
+			return nil, errors.New("proxyJump is wrong format")
+		}
+		s.host = h
+		if port != "" {
+			p, err := strconv.Atoi(port)
+			if err != nil || p <= 0 || p > 65535 {
+				return nil, errors.New("proxyJump is wrong format")
+			}
+			s.port = p
+		}
+		specs = append(specs, s)
+	}
+	return specs, nil
+}
+
+// jumpHosts resolves each host of ProxyJump through Config and returns their DialConfigs.
+// visited is the set of hosts in the current chain, used to avoid loops such as `Host *` with ProxyJump.
+func (c *Config) jumpHosts(r *ResolvedHost, visited map[string]bool) ([]*DialConfig, error) {
+	if r.ProxyCommand != "" && !strings.EqualFold(r.ProxyCommand, "none") {
+		// ProxyCommand takes precedence
+		return nil, nil
+	}
+	specs, err := parseProxyJump(r.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	for _, s := range specs {
+		if visited[s.host] {
+			return nil, nil
+		}
+	}
+	jc := c.withoutOverrides()
+	var jumpHosts []*DialConfig
+	for i, s := range specs {
+		jr, err := jc.Resolve(s.host)
+		if err != nil {
+			return nil, err
+		}
+		if s.user != "" {
+			jr.User = s.user
+		}
+		if s.port != 0 {
+			jr.Port = s.port
+		}
+		if i > 0 {
+			// Subsequent jump hosts are reached through the previous one
+			jr.ProxyCommand = ""
+			jr.ProxyJump = ""
+		}
+		v := map[string]bool{s.host: true}
+		for h := range visited {
+			v[h] = true
+		}
+		dc, err := jc.dialConfig(jr, v)
+		if err != nil {
+			return nil, err
+		}
+		jumpHosts = append(jumpHosts, dc)
+	}
+	return jumpHosts, nil
+}
+
+// withoutOverrides returns a copy of Config without the User, Port and Hostname options.
+// These options are for the destination host and must not be applied to jump hosts.
+func (c *Config) withoutOverrides() *Config {
+	jc := *c
+	jc.user = ""
+	jc.port = 0
+	jc.hostname = ""
+	jc.evaluations = newEvaluations()
+	return &jc
+}
+
+// jumpHosts returns DialConfigs of ProxyJump hosts that inherit the options of dc except HostKeyAlias and CheckHostIP.
+func (dc *DialConfig) jumpHosts() ([]*DialConfig, error) {
+	specs, err := parseProxyJump(dc.ProxyJump)
+	if err != nil {
+		return nil, err
+	}
+	var jumpHosts []*DialConfig
+	for _, s := range specs {
+		jh := *dc
+		jh.ProxyCommand = ""
+		jh.ProxyJump = ""
+		jh.JumpHosts = nil
+		// the alias and the IP check are for the target host
+		jh.HostKeyAlias = ""
+		jh.CheckHostIP = false
+		jh.Hostname = s.host
+		jh.Port = s.port
+		if jh.Port == 0 {
+			jh.Port = 22
+		}
+		if s.user != "" {
+			jh.User = s.user
+		}
+		jumpHosts = append(jumpHosts, &jh)
+	}
+	return jumpHosts, nil
+}
+
+// dialViaJumpHosts connects to the jump hosts in order, each through the previous one, and then to addr through the last one.
+// Closing the returned client closes all jump host clients.
+func dialViaJumpHosts(ctx context.Context, jumpHosts []*DialConfig, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var via *ssh.Client
+	for _, jh := range jumpHosts {
+		c, err := dialContext(ctx, jh, via)
+		if err != nil {
+			if via != nil {
+				_ = via.Close()
+			}
+			return nil, fmt.Errorf("proxy jump %s: %w", net.JoinHostPort(jh.Hostname, strconv.Itoa(jh.Port)), err)
+		}
+		closeAfter(c, via)
+		via = c
+	}
+	conn, err := via.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		_ = via.Close()
+		return nil, err
+	}
+	c, err := newClientConn(ctx, conn, addr, config)
+	if err != nil {
+		_ = via.Close()
+		return nil, err
+	}
+	closeAfter(c, via)
+	return c, nil
+}
+
+// closeAfter closes via after c is closed.
+func closeAfter(c, via *ssh.Client) {
+	if via == nil {
+		return
+	}
+	go func() {
+		_ = c.Wait()
+		_ = via.Close()
+	}()
+}
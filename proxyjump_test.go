@@ -0,0 +1,214 @@
+package sshc
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseProxyJump(t *testing.T) {
+	tests := []struct {
+		name    string
+		text    string
+		want    []jumpSpec
+		wantErr bool
+	}{
+		{
+			name: "full config",
+			text: "user@host:2002",
+			want: []jumpSpec{{user: "user", host: "host", port: 2002}},
+		},
+		{
+			name: "not defined port",
+			text: "user@host",
+			want: []jumpSpec{{user: "user", host: "host"}},
+		},
+		{
+			name: "not defined user",
+			text: "host:2222",
+			want: []jumpSpec{{host: "host", port: 2222}},
+		},
+		{
+			name: "chain",
+			text: "user@host:2222,user2@host2",
+			want: []jumpSpec{{user: "user", host: "host", port: 2222}, {user: "user2", host: "host2"}},
+		},
+		{
+			name: "uri and ipv6",
+			text: "ssh://user@[::1]:2222,[fe80::1]",
+			want: []jumpSpec{{user: "user", host: "::1", port: 2222}, {host: "fe80::1"}},
+		},
+		{
+			name: "none",
+			text: "none",
+			want: nil,
+		},
+		{
+			name:    "wrong port format",
+			text:    "user@host:xxxxx",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseProxyJump(tt.text)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("parseProxyJump() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("parseProxyJump() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJumpHostsDoNotInheritHostKeyAlias(t *testing.T) {
+	dc := &DialConfig{Hostname: "target", Port: 22, ProxyJump: "jump", HostKeyAlias: "myalias", CheckHostIP: true}
+	jumpHosts, err := dc.jumpHosts()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(jumpHosts) != 1 {
+		t.Fatalf("got %v", jumpHosts)
+	}
+	if got := jumpHosts[0].HostKeyAlias; got != "" {
+		t.Errorf("got %v", got)
+	}
+	if got := jumpHosts[0].CheckHostIP; got {
+		t.Errorf("got %v", got)
+	}
+}
+
+func TestProxyJump(t *testing.T) {
+	bastion := newTestServer(t, "bastion")
+	bastion2 := newTestServer(t, "bastion2")
+	target := newTestServer(t, "target")
+	key, err := filepath.Abs("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(fmt.Sprintf(`Host bastion
+  HostName %s
+  Port %d
+  User jumper
+
+Host bastion2
+  HostName %s
+  Port %d
+  ProxyJump bastion
+
+Host target
+  HostName %s
+  Port %d
+  User k1low
+  ProxyJump bastion,alice@bastion2
+
+Host target-none
+  HostName %s
+  Port %d
+  ProxyJump none
+
+Host *
+  IdentityFile %s
+  ProxyJump bastion
+  StrictHostKeyChecking no
+`, bastion.host, bastion.port, bastion2.host, bastion2.port, target.host, target.port, target.host, target.port, key))
+
+	t.Run("multi-hop", func(t *testing.T) {
+		client, err := NewClient("target", ClearConfig(), ConfigData(data), UseAgent(false), User("override"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if got, want := runHostname(t, client), "target\n"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if got := bastion.directTCPIP.Load(); got != 1 {
+			t.Errorf("bastion direct-tcpip got %v want 1", got)
+		}
+		if got := bastion2.directTCPIP.Load(); got != 1 {
+			t.Errorf("bastion2 direct-tcpip got %v want 1", got)
+		}
+		if got, want := bastion.users, []string{"jumper"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if got, want := bastion2.users, []string{"alice"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+		if got, want := target.users, []string{"override"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("ProxyJump none", func(t *testing.T) {
+		c, err := NewConfig(ClearConfig(), ConfigData(data), UseAgent(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := c.Resolve("target-none")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc, err := c.DialConfig(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dc.JumpHosts) != 0 {
+			t.Errorf("got %d jump hosts", len(dc.JumpHosts))
+		}
+		client, err := Dial(dc)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+		if got, want := runHostname(t, client), "target\n"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("jump host itself matches Host *", func(t *testing.T) {
+		c, err := NewConfig(ClearConfig(), ConfigData(data), UseAgent(false))
+		if err != nil {
+			t.Fatal(err)
+		}
+		r, err := c.Resolve("bastion")
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc, err := c.DialConfig(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dc.JumpHosts) != 0 {
+			t.Errorf("got %d jump hosts", len(dc.JumpHosts))
+		}
+	})
+}
+
+func TestProxyJumpConnectTimeout(t *testing.T) {
+	bastion := newTestServer(t, "bastion")
+	target := newSilentServer(t)
+	key, err := filepath.Abs("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("HOME", t.TempDir())
+	data := fmt.Sprintf("Host bastion\n  HostName %s\n  Port %d\n\nHost target\n  HostName %s\n  Port %d\n  ProxyJump bastion\n\nHost *\n  IdentityFile %s\n  ConnectTimeout 1\n", bastion.host, bastion.port, target.IP, target.Port, key)
+	start := time.Now()
+	// the channel through the jump host does not support deadlines
+	_, err = NewClient("target", ClearConfig(), ConfigData([]byte(data)), UseAgent(false), InsecureIgnoreHostKey())
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("NewClient did not return promptly: %v", elapsed)
+	}
+	if got := bastion.directTCPIP.Load(); got != 1 {
+		t.Errorf("bastion direct-tcpip got %v want 1", got)
+	}
+}
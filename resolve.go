@@ -0,0 +1,471 @@
+package sshc
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// ResolvedHost is the fully evaluated configuration for a host (like `ssh -G`).
+type ResolvedHost struct {
+	// Host is the host name given to Resolve (the alias in ssh_config).
+	Host     string
+	Hostname string
+	User     string
+	Port     int
+
+	IdentityFiles    []string
+	CertificateFiles []string
+	IdentitiesOnly   bool
+
+	ProxyCommand string
+	ProxyJump    string
+	ControlPath  string
+
+	StrictHostKeyChecking string
+	UserKnownHostsFiles   []string
+	GlobalKnownHostsFiles []string
+	HostKeyAlias          string
+	CheckHostIP           bool
+	HashKnownHosts        bool
+
+	BatchMode                    bool
+	PreferredAuthentications     []string
+	PubkeyAuthentication         bool
+	PasswordAuthentication       bool
+	KbdInteractiveAuthentication bool
+	NumberOfPasswordPrompts      int
+
+	ConnectTimeout      time.Duration
+	ConnectionAttempts  int
+	ServerAliveInterval time.Duration
+	ServerAliveCountMax int
+
+	// Ciphers, MACs, KexAlgorithms and HostKeyAlgorithms are the values as written in ssh_config ( or set by Options ).
+	// They are empty when not set.
+	Ciphers           string
+	MACs              string
+	KexAlgorithms     string
+	HostKeyAlgorithms string
+
+	LocalForwards        []string
+	RemoteForwards       []string
+	DynamicForwards      []string
+	ExitOnForwardFailure bool
+}
+
+// Resolve evaluates ssh_config(5) and the options of Config for host and returns *ResolvedHost.
+func (c *Config) Resolve(host string) (*ResolvedHost, error) {
+	var err error
+	r := &ResolvedHost{
+		Host:         host,
+		User:         c.getUser(host),
+		ProxyJump:    c.getRaw(host, "ProxyJump"),
+		HostKeyAlias: c.getRaw(host, "HostKeyAlias"),
+	}
+	r.Hostname, err = c.getHostname(host)
+	if err != nil {
+		return nil, err
+	}
+	r.Port, err = c.getPort(host)
+	if err != nil {
+		return nil, c.valueError(host, "Port", err)
+	}
+
+	t := &tokens{
+		host:         host,
+		hostname:     r.Hostname,
+		user:         r.User,
+		port:         r.Port,
+		proxyJump:    r.ProxyJump,
+		hostKeyAlias: r.HostKeyAlias,
+	}
+	r.IdentityFiles, err = c.getIdentityFiles(host, t)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range c.getRawAll(host, "CertificateFile") {
+		f, err := t.expand(v.val, fileTokens, true)
+		if err != nil {
+			return nil, c.valueError(host, "CertificateFile", err)
+		}
+		p, err := expandPath(f, v.base)
+		if err != nil {
+			return nil, err
+		}
+		r.CertificateFiles = append(r.CertificateFiles, p)
+	}
+
+	pc, _ := c.getProxyCommand(host)
+	r.ProxyCommand, err = t.expand(pc, proxyTokens, false)
+	if err != nil {
+		return nil, c.valueError(host, "ProxyCommand", err)
+	}
+	r.ProxyJump, err = t.expand(r.ProxyJump, proxyTokens, false)
+	if err != nil {
+		return nil, c.valueError(host, "ProxyJump", err)
+	}
+	if cp, base := c.getRawWithBase(host, "ControlPath"); cp != "" && !strings.EqualFold(cp, "none") {
+		r.ControlPath, err = t.expand(cp, fileTokens, true)
+		if err != nil {
+			return nil, c.valueError(host, "ControlPath", err)
+		}
+		r.ControlPath, err = expandPath(r.ControlPath, base)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.StrictHostKeyChecking, err = c.getStrictHostKeyChecking(host)
+	if err != nil {
+		return nil, err
+	}
+	if len(c.knownhosts) > 0 {
+		r.UserKnownHostsFiles = c.knownhosts
+	} else {
+		r.UserKnownHostsFiles, err = c.getFiles(host, "UserKnownHostsFile", t)
+		if err != nil {
+			return nil, err
+		}
+		// GlobalKnownHostsFile does not accept tokens
+		r.GlobalKnownHostsFiles, err = c.getFiles(host, "GlobalKnownHostsFile", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	r.PreferredAuthentications = splitList(c.getRaw(host, "PreferredAuthentications"))
+
+	bools := []struct {
+		key string
+		dst *bool
+	}{
+		{"IdentitiesOnly", &r.IdentitiesOnly},
+		{"CheckHostIP", &r.CheckHostIP},
+		{"HashKnownHosts", &r.HashKnownHosts},
+		{"BatchMode", &r.BatchMode},
+		{"PasswordAuthentication", &r.PasswordAuthentication},
+		{"KbdInteractiveAuthentication", &r.KbdInteractiveAuthentication},
+		{"ExitOnForwardFailure", &r.ExitOnForwardFailure},
+	}
+	for _, b := range bools {
+		*b.dst, err = parseYesNo(c.getRaw(host, b.key))
+		if err != nil {
+			return nil, c.valueError(host, b.key, err)
+		}
+	}
+
+	// unbound and host-bound are the variants of yes
+	switch v := c.getRaw(host, "PubkeyAuthentication"); strings.ToLower(v) {
+	case "unbound", "host-bound":
+		r.PubkeyAuthentication = true
+	default:
+		r.PubkeyAuthentication, err = parseYesNo(v)
+		if err != nil {
+			return nil, c.valueError(host, "PubkeyAuthentication", err)
+		}
+	}
+
+	ints := []struct {
+		key string
+		dst *int
+	}{
+		{"NumberOfPasswordPrompts", &r.NumberOfPasswordPrompts},
+		{"ConnectionAttempts", &r.ConnectionAttempts},
+		{"ServerAliveCountMax", &r.ServerAliveCountMax},
+	}
+	for _, i := range ints {
+		*i.dst, err = strconv.Atoi(c.getRaw(host, i.key))
+		if err != nil {
+			return nil, c.valueError(host, i.key, err)
+		}
+	}
+
+	durations := []struct {
+		key string
+		dst *time.Duration
+	}{
+		{"ConnectTimeout", &r.ConnectTimeout},
+		{"ServerAliveInterval", &r.ServerAliveInterval},
+	}
+	for _, d := range durations {
+		*d.dst, err = parseTime(c.getRaw(host, d.key))
+		if err != nil {
+			return nil, c.valueError(host, d.key, err)
+		}
+	}
+	if r.ConnectionAttempts < 1 {
+		return nil, c.valueError(host, "ConnectionAttempts", fmt.Errorf("must be greater than 0, got %d", r.ConnectionAttempts))
+	}
+	if c.connectTimeout > 0 {
+		r.ConnectTimeout = c.connectTimeout
+	}
+	if c.connectionAttempts > 0 {
+		r.ConnectionAttempts = c.connectionAttempts
+	}
+
+	algos := []struct {
+		key       string
+		opt       string
+		dst       *string
+		defaults  []string
+		supported []string
+	}{
+		{"Ciphers", c.ciphers, &r.Ciphers, defaultCiphers, supportedCiphers()},
+		{"MACs", c.macs, &r.MACs, defaultMACs, supportedMACs()},
+		{"KexAlgorithms", c.kexAlgorithms, &r.KexAlgorithms, defaultKexAlgorithms, supportedKexAlgorithms()},
+		{"HostKeyAlgorithms", c.hostKeyAlgorithms, &r.HostKeyAlgorithms, defaultHostKeyAlgorithms, supportedHostKeyAlgorithms()},
+	}
+	for _, a := range algos {
+		if a.opt != "" {
+			// already validated by the Option
+			*a.dst = a.opt
+			continue
+		}
+		*a.dst, _, _ = c.lookupRaw(host, a.key)
+		if _, err := assembleAlgorithms(*a.dst, a.defaults, a.supported); err != nil {
+			return nil, c.valueError(host, a.key, err)
+		}
+	}
+
+	forwards := []struct {
+		key string
+		dst *[]string
+	}{
+		{"LocalForward", &r.LocalForwards},
+		{"RemoteForward", &r.RemoteForwards},
+	}
+	for _, f := range forwards {
+		for _, v := range c.getRawAll(host, f.key) {
+			// tokens are for the paths of Unix domain sockets
+			fw, err := t.expand(v.val, fileTokens, true)
+			if err != nil {
+				return nil, c.valueError(host, f.key, err)
+			}
+			*f.dst = append(*f.dst, fw)
+		}
+	}
+	for _, v := range c.getRawAll(host, "DynamicForward") {
+		r.DynamicForwards = append(r.DynamicForwards, v.val)
+	}
+
+	return r, nil
+}
+
+// DialConfig returns *DialConfig built from r and the options of Config.
+func (c *Config) DialConfig(r *ResolvedHost) (*DialConfig, error) {
+	return c.dialConfig(r, map[string]bool{r.Host: true})
+}
+
+func (c *Config) dialConfig(r *ResolvedHost, visited map[string]bool) (*DialConfig, error) {
+	_, wd := c.getProxyCommand(r.Host)
+	if wd == "" {
+		var err error
+		wd, err = os.Getwd()
+		if err != nil {
+			return nil, err
+		}
+	}
+	keys, err := c.getKeyAndPassphrases(r.Host, r.IdentityFiles)
+	if err != nil {
+		return nil, err
+	}
+	certs, err := c.getCertificates(r.Host, r.CertificateFiles, keys)
+	if err != nil {
+		return nil, err
+	}
+	jumpHosts, err := c.jumpHosts(r, visited)
+	if err != nil {
+		return nil, err
+	}
+	proxyJump := r.ProxyJump
+	if len(jumpHosts) == 0 {
+		// ProxyJump is none, overridden by ProxyCommand or looped
+		proxyJump = ""
+	}
+	var kbdInteractive ssh.KeyboardInteractiveChallenge
+	if r.KbdInteractiveAuthentication {
+		switch {
+		case c.kbdInteractive != nil:
+			kbdInteractive = c.kbdInteractive
+		case r.BatchMode:
+			// no prompts in batch mode
+		case c.prompter != nil:
+			kbdInteractive = c.prompter.KeyboardInteractive
+		default:
+			// e.g. OTP of a bastion is asked on the terminal, as passphrases are
+			kbdInteractive = TerminalPrompter{}.KeyboardInteractive
+		}
+	}
+	preferred := []string{}
+	for _, m := range r.PreferredAuthentications {
+		switch {
+		case m == authPublickey && r.PubkeyAuthentication,
+			m == authPassword && r.PasswordAuthentication,
+			m == authKeyboardInteractive && r.KbdInteractiveAuthentication:
+			preferred = append(preferred, m)
+		}
+	}
+	algos := map[string][]string{}
+	for _, a := range []struct {
+		key       string
+		v         string
+		defaults  []string
+		supported []string
+	}{
+		{"Ciphers", r.Ciphers, defaultCiphers, supportedCiphers()},
+		{"MACs", r.MACs, defaultMACs, supportedMACs()},
+		{"KexAlgorithms", r.KexAlgorithms, defaultKexAlgorithms, supportedKexAlgorithms()},
+		{"HostKeyAlgorithms", r.HostKeyAlgorithms, defaultHostKeyAlgorithms, supportedHostKeyAlgorithms()},
+	} {
+		algos[a.key], err = assembleAlgorithms(a.v, a.defaults, a.supported)
+		if err != nil {
+			return nil, c.valueError(r.Host, a.key, err)
+		}
+	}
+	return &DialConfig{
+		Hostname:                 r.Hostname,
+		User:                     r.User,
+		Port:                     r.Port,
+		ProxyCommand:             escapeTokens(r.ProxyCommand), // tokens are already expanded
+		ProxyJump:                proxyJump,
+		Knownhosts:               r.UserKnownHostsFiles,
+		GlobalKnownhosts:         r.GlobalKnownHostsFiles,
+		StrictHostKeyChecking:    r.StrictHostKeyChecking,
+		InsecureIgnoreHostKey:    c.insecureHostKey,
+		HostCertAuthorities:      c.getHostCertAuthorities(r.Host),
+		HostKeyAlias:             r.HostKeyAlias,
+		HostKeyAlgorithms:        algos["HostKeyAlgorithms"],
+		Ciphers:                  algos["Ciphers"],
+		MACs:                     algos["MACs"],
+		KexAlgorithms:            algos["KexAlgorithms"],
+		CheckHostIP:              r.CheckHostIP,
+		HashKnownHosts:           r.HashKnownHosts,
+		UseAgent:                 c.useAgent,
+		Password:                 c.password,
+		Timeout:                  r.ConnectTimeout,
+		ConnectionAttempts:       r.ConnectionAttempts,
+		ProxyCommandTimeout:      c.proxyTimeout,
+		ProxyCommandStderr:       c.proxyStderr,
+		Wd:                       wd,
+		Auth:                     c.auth,
+		DialTimeoutFunc:          c.dialTimeoutFunc,
+		KeyAndPassphrases:        keys,
+		Certificates:             certs,
+		IdentitiesOnly:           r.IdentitiesOnly,
+		Prompter:                 c.prompter,
+		BatchMode:                r.BatchMode,
+		KeyboardInteractive:      kbdInteractive,
+		NumberOfPasswordPrompts:  r.NumberOfPasswordPrompts,
+		PreferredAuthentications: preferred,
+		JumpHosts:                jumpHosts,
+	}, nil
+}
+
+// valueError returns the error for the invalid value of key.
+// If the value is from ssh_config, *ConfigParseError pointing to the line is returned.
+func (c *Config) valueError(host, key string, err error) error {
+	err = fmt.Errorf("invalid %s: %w", key, err)
+	vals := c.getRawAll(host, key)
+	if len(vals) == 0 {
+		return err
+	}
+	return &ConfigParseError{File: vals[0].path, Line: vals[0].line, Err: err}
+}
+
+// getFiles returns the whitespace separated file list of key with tokens and paths expanded.
+// If t is nil, tokens are not expanded.
+func (c *Config) getFiles(host, key string, t *tokens) ([]string, error) {
+	v, base := c.getRawWithBase(host, key)
+	var files []string
+	for _, f := range strings.Fields(v) {
+		if strings.EqualFold(f, "none") {
+			return nil, nil
+		}
+		if t != nil {
+			var err error
+			f, err = t.expand(f, fileTokens, true)
+			if err != nil {
+				return nil, c.valueError(host, key, err)
+			}
+		}
+		p, err := expandPath(f, base)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, p)
+	}
+	return files, nil
+}
+
+func splitList(v string) []string {
+	var l []string
+	for _, e := range strings.Split(v, ",") {
+		e = strings.TrimSpace(e)
+		if e == "" {
+			continue
+		}
+		l = append(l, e)
+	}
+	return l
+}
+
+func parseYesNo(v string) (bool, error) {
+	switch strings.ToLower(v) {
+	case "yes", "true":
+		return true, nil
+	case "no", "false", "":
+		return false, nil
+	}
+	return false, fmt.Errorf("must be 'yes' or 'no', got %q", v)
+}
+
+// parseTime parses a time value in sshd_config(5) TIME FORMATS (e.g. 30, 10s, 1h30m).
+func parseTime(v string) (time.Duration, error) {
+	if v == "" || strings.EqualFold(v, "none") {
+		return 0, nil
+	}
+	units := map[byte]time.Duration{
+		's': time.Second,
+		'S': time.Second,
+		'm': time.Minute,
+		'M': time.Minute,
+		'h': time.Hour,
+		'H': time.Hour,
+		'd': 24 * time.Hour,
+		'D': 24 * time.Hour,
+		'w': 7 * 24 * time.Hour,
+		'W': 7 * 24 * time.Hour,
+	}
+	var total time.Duration
+	num := ""
+	for i := 0; i < len(v); i++ {
+		ch := v[i]
+		if ch >= '0' && ch <= '9' {
+			num += string(ch)
+			continue
+		}
+		unit, ok := units[ch]
+		if !ok || num == "" {
+			return 0, fmt.Errorf("invalid time format %q", v)
+		}
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(n) * unit
+		num = ""
+	}
+	if num != "" {
+		n, err := strconv.Atoi(num)
+		if err != nil {
+			return 0, err
+		}
+		total += time.Duration(n) * time.Second
+	}
+	return total, nil
+}
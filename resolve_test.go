@@ -0,0 +1,218 @@
+package sshc
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestResolve(t *testing.T) {
+	t.Setenv("HOME", "/home/testuser")
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := []byte(`Host myhost
+  HostName 203.0.113.1
+  User k1low
+  Port 10022
+  IdentityFile keys/%h_%r
+  ProxyCommand nc %h %p
+  UserKnownHostsFile ~/.ssh/known_hosts_%h
+  StrictHostKeyChecking yes
+  ConnectTimeout 1m30s
+  Ciphers aes128-ctr
+  LocalForward 5432 db:5432
+  LocalForward 6379 cache:6379
+  BatchMode yes
+
+Host *
+  DynamicForward 1080
+`)
+	c, err := NewConfig(ClearConfig(), ConfigData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Resolve("myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Hostname, "203.0.113.1"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.User, "k1low"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.Port, 10022; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.IdentityFiles, []string{filepath.Join(wd, "keys", "203.0.113.1_k1low")}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.ProxyCommand, "nc 203.0.113.1 10022"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.UserKnownHostsFiles, []string{"/home/testuser/.ssh/known_hosts_203.0.113.1"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.StrictHostKeyChecking, "yes"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.ConnectTimeout, 90*time.Second; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.Ciphers, "aes128-ctr"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.MACs, ""; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := len(r.LocalForwards), 2; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.DynamicForwards, []string{"1080"}; len(got) != 1 || got[0] != want[0] {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if !r.BatchMode {
+		t.Error("BatchMode should be true")
+	}
+
+	dc, err := c.DialConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc.Hostname, r.Hostname; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := dc.ProxyCommand, r.ProxyCommand; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestResolveTokens(t *testing.T) {
+	t.Setenv("HOME", "/home/testuser")
+	t.Setenv("SSHC_KEYS", "/keys")
+	data := []byte(`Host myhost
+  HostName %h.example.com
+  User k1low
+  IdentityFile ${SSHC_KEYS}/%n_%u
+  ProxyCommand printf '%%s' %n %h
+  ControlPath %d/.ssh/cm-%r@%h:%p
+  LocalForward /tmp/%n.sock localhost:5432
+
+Host badproxy
+  ProxyCommand nc %d %p
+
+Host badfile
+  IdentityFile ~/.ssh/%x
+`)
+	c, err := NewConfig(ClearConfig(), ConfigData(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Resolve("myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.Hostname, "myhost.example.com"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.IdentityFiles, []string{"/keys/myhost_" + localUsername()}; !slices.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.ProxyCommand, "printf '%s' myhost myhost.example.com"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.ControlPath, "/home/testuser/.ssh/cm-k1low@myhost.example.com:22"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.LocalForwards, []string{"/tmp/myhost.sock localhost:5432"}; !slices.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+	dc, err := c.DialConfig(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := dc.ProxyCommand, "printf '%%s' myhost myhost.example.com"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+
+	for _, host := range []string{"badproxy", "badfile"} {
+		if _, err := c.Resolve(host); err == nil {
+			t.Errorf("%s: want error", host)
+		}
+	}
+}
+
+func TestResolveOverriddenByOption(t *testing.T) {
+	c, err := NewConfig(ClearConfig(), ConfigPath("./testdata/simple/.ssh/config"), User("alice"), Port(2222))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Resolve("bastion")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := r.User, "alice"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.Port, 2222; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := r.Hostname, "127.0.0.1"; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestResolveIdentityFiles(t *testing.T) {
+	t.Setenv("HOME", "/home/testuser")
+	c, err := NewConfig(ClearConfig(),
+		ConfigData([]byte("Host myhost\n  IdentityFile ~/.ssh/id_%h\n  IdentityFile ~/.ssh/id_ed25519\n\nHost *\n  IdentityFile ~/.ssh/id_rsa\n")),
+		AppendConfigData([]byte("Host my*\n  IdentityFile ~/.ssh/id_ecdsa\n  IdentityFile ~/.ssh/id_rsa\n")),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := c.Resolve("myhost")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// appended config is evaluated first
+	want := []string{
+		"/home/testuser/.ssh/id_ecdsa",
+		"/home/testuser/.ssh/id_rsa",
+		"/home/testuser/.ssh/id_myhost",
+		"/home/testuser/.ssh/id_ed25519",
+	}
+	if got := r.IdentityFiles; !slices.Equal(got, want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestParseTime(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"30", 30 * time.Second, false},
+		{"10s", 10 * time.Second, false},
+		{"1h30m", 90 * time.Minute, false},
+		{"1w", 7 * 24 * time.Hour, false},
+		{"10x", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := parseTime(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("got error %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package sshc
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	socks4Version = 0x04
+	socks5Version = 0x05
+
+	socksCmdConnect = 0x01
+
+	socks4Granted  = 0x5a
+	socks4Rejected = 0x5b
+
+	socks5NoAuth              = 0x00
+	socks5NoAcceptableMethods = 0xff
+	socks5AddrIPv4            = 0x01
+	socks5AddrDomain          = 0x03
+	socks5AddrIPv6            = 0x04
+
+	socks5Succeeded           = 0x00
+	socks5GeneralFailure      = 0x01
+	socks5CmdNotSupported     = 0x07
+	socks5AddrTypeUnsupported = 0x08
+
+	// socksMaxStringLen bounds the user ID and the domain name of SOCKS4a requests.
+	socksMaxStringLen = 255
+)
+
+// SOCKSRequest is a CONNECT request to the SOCKS server of DynamicForward.
+type SOCKSRequest struct {
+	// Version is the SOCKS version ( 4 or 5 ). SOCKS4a requests are version 4.
+	Version int
+	// Source is the address of the SOCKS client.
+	Source net.Addr
+	// Target is the destination ( host:port ) dialed through *ssh.Client.
+	Target string
+}
+
+// DynamicForwardOption is the option of DynamicForward.
+type DynamicForwardOption func(*dynamicForward)
+
+type dynamicForward struct {
+	client    *ssh.Client
+	onRequest func(req SOCKSRequest, err error)
+}
+
+// OnSOCKSRequest returns DynamicForwardOption that calls fn for each CONNECT request with the error of dialing the target ( nil if it succeeded ).
+// fn is called concurrently from the goroutines serving the connections.
+func OnSOCKSRequest(fn func(req SOCKSRequest, err error)) DynamicForwardOption {
+	return func(d *dynamicForward) {
+		d.onRequest = fn
+	}
+}
+
+// DynamicForward listens on localAddr as a SOCKS server ( SOCKS5 without authentication, SOCKS4 and SOCKS4a ) and dials the targets of CONNECT requests through client, like `ssh -D`.
+// localAddr is `[bind_address:]port` or the path of a Unix domain socket. If bind_address is omitted, localhost is used, and `*` means all interfaces.
+func DynamicForward(ctx context.Context, client *ssh.Client, localAddr string, opts ...DynamicForwardOption) (*Forwarding, error) {
+	network, addr, err := parseListenAddr(localAddr)
+	if err != nil {
+		return nil, err
+	}
+	d := &dynamicForward{client: client}
+	for _, opt := range opts {
+		opt(d)
+	}
+	lc := &net.ListenConfig{}
+	ln, err := lc.Listen(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	return newForwarding(ctx, client, ln, d.serve), nil
+}
+
+// serve handles a connection of a SOCKS client.
+func (d *dynamicForward) serve(ctx context.Context, conn net.Conn) {
+	// the handshake is interrupted when the forwarding stops
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	rconn, err := d.handshake(ctx, conn)
+	if !stop() || err != nil {
+		_ = conn.Close()
+		if rconn != nil {
+			_ = rconn.Close()
+		}
+		return
+	}
+	proxyConn(ctx, conn, rconn)
+}
+
+// handshake reads a request from conn, dials the target and replies.
+func (d *dynamicForward) handshake(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	ver := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ver); err != nil {
+		return nil, err
+	}
+	switch ver[0] {
+	case socks4Version:
+		return d.handshake4(ctx, conn)
+	case socks5Version:
+		return d.handshake5(ctx, conn)
+	}
+	return nil, fmt.Errorf("unsupported SOCKS version %d", ver[0])
+}
+
+func (d *dynamicForward) handshake4(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	// CMD, DSTPORT, DSTIP
+	b := make([]byte, 7)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	if _, err := readCString(conn); err != nil { // USERID
+		return nil, err
+	}
+	host := net.IP(b[3:7]).String()
+	if b[3] == 0 && b[4] == 0 && b[5] == 0 && b[6] != 0 {
+		// SOCKS4a
+		h, err := readCString(conn)
+		if err != nil {
+			return nil, err
+		}
+		host = h
+	}
+	reply := func(code byte) error {
+		_, err := conn.Write([]byte{0x00, code, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	if b[0] != socksCmdConnect {
+		_ = reply(socks4Rejected)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", b[0])
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(b[1:3]))))
+	rconn, err := d.dial(ctx, socks4Version, conn, target)
+	if err != nil {
+		_ = reply(socks4Rejected)
+		return nil, err
+	}
+	return rconn, reply(socks4Granted)
+}
+
+func (d *dynamicForward) handshake5(ctx context.Context, conn net.Conn) (net.Conn, error) {
+	// NMETHODS, METHODS
+	n := make([]byte, 1)
+	if _, err := io.ReadFull(conn, n); err != nil {
+		return nil, err
+	}
+	methods := make([]byte, n[0])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return nil, err
+	}
+	method := byte(socks5NoAcceptableMethods)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return nil, err
+	}
+	if method != socks5NoAuth {
+		return nil, errors.New("no acceptable SOCKS authentication method")
+	}
+
+	// VER, CMD, RSV, ATYP
+	b := make([]byte, 4)
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+	reply := func(code byte) error {
+		_, err := conn.Write([]byte{socks5Version, code, 0x00, socks5AddrIPv4, 0, 0, 0, 0, 0, 0})
+		return err
+	}
+	if b[0] != socks5Version {
+		return nil, fmt.Errorf("unsupported SOCKS version %d", b[0])
+	}
+	var host string
+	switch b[3] {
+	case socks5AddrIPv4, socks5AddrIPv6:
+		ip := make([]byte, net.IPv4len)
+		if b[3] == socks5AddrIPv6 {
+			ip = make([]byte, net.IPv6len)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return nil, err
+		}
+		host = net.IP(ip).String()
+	case socks5AddrDomain:
+		l := make([]byte, 1)
+		if _, err := io.ReadFull(conn, l); err != nil {
+			return nil, err
+		}
+		name := make([]byte, l[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return nil, err
+		}
+		host = string(name)
+	default:
+		_ = reply(socks5AddrTypeUnsupported)
+		return nil, fmt.Errorf("unsupported SOCKS address type %d", b[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(conn, port); err != nil {
+		return nil, err
+	}
+	if b[1] != socksCmdConnect {
+		_ = reply(socks5CmdNotSupported)
+		return nil, fmt.Errorf("unsupported SOCKS command %d", b[1])
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+	rconn, err := d.dial(ctx, socks5Version, conn, target)
+	if err != nil {
+		_ = reply(socks5GeneralFailure)
+		return nil, err
+	}
+	return rconn, reply(socks5Succeeded)
+}
+
+// dial dials target through the client and reports the request to the hook.
+func (d *dynamicForward) dial(ctx context.Context, version int, conn net.Conn, target string) (net.Conn, error) {
+	rconn, err := d.client.DialContext(ctx, "tcp", target)
+	if d.onRequest != nil {
+		d.onRequest(SOCKSRequest{Version: version, Source: conn.RemoteAddr(), Target: target}, err)
+	}
+	return rconn, err
+}
+
+// readCString reads a null-terminated string of SOCKS4.
+func readCString(r io.Reader) (string, error) {
+	var s []byte
+	b := make([]byte, 1)
+	for {
+		if _, err := io.ReadFull(r, b); err != nil {
+			return "", err
+		}
+		if b[0] == 0 {
+			return string(s), nil
+		}
+		if len(s) >= socksMaxStringLen {
+			return "", errors.New("too long string in SOCKS request")
+		}
+		s = append(s, b[0])
+	}
+}
@@ -0,0 +1,215 @@
+package sshc
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDynamicForward(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	host, p, err := net.SplitHostPort(echo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var (
+		mu       sync.Mutex
+		requests []SOCKSRequest
+	)
+	client := newTestClient(t, srv)
+	f, err := DynamicForward(context.Background(), client, "127.0.0.1:0", OnSOCKSRequest(func(req SOCKSRequest, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, req)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = f.Close()
+	})
+
+	ip4 := net.ParseIP(host).To4()
+	tests := []struct {
+		name      string
+		request   []byte
+		wantReply []byte
+		wantEcho  bool
+	}{
+		{
+			"SOCKS5 IPv4",
+			append(append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01}, ip4...), byte(port>>8), byte(port)),
+			[]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			true,
+		},
+		{
+			"SOCKS5 domain",
+			append(append([]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x03, byte(len(host))}, host...), byte(port>>8), byte(port)),
+			[]byte{0x05, 0x00, 0x05, 0x00, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			true,
+		},
+		{
+			"SOCKS5 unreachable",
+			[]byte{0x05, 0x01, 0x00, 0x05, 0x01, 0x00, 0x01, 127, 0, 0, 1, 0, 0},
+			[]byte{0x05, 0x00, 0x05, 0x01, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			false,
+		},
+		{
+			"SOCKS5 BIND is not supported",
+			append(append([]byte{0x05, 0x01, 0x00, 0x05, 0x02, 0x00, 0x01}, ip4...), byte(port>>8), byte(port)),
+			[]byte{0x05, 0x00, 0x05, 0x07, 0x00, 0x01, 0, 0, 0, 0, 0, 0},
+			false,
+		},
+		{
+			"SOCKS5 authentication required",
+			[]byte{0x05, 0x01, 0x02},
+			[]byte{0x05, 0xff},
+			false,
+		},
+		{
+			"SOCKS4",
+			append(append([]byte{0x04, 0x01, byte(port >> 8), byte(port)}, ip4...), 'u', 0x00),
+			[]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0},
+			true,
+		},
+		{
+			"SOCKS4a",
+			append(append([]byte{0x04, 0x01, byte(port >> 8), byte(port), 0, 0, 0, 1, 0x00}, host...), 0x00),
+			[]byte{0x00, 0x5a, 0, 0, 0, 0, 0, 0},
+			true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.Dial("tcp", f.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			if _, err := conn.Write(tt.request); err != nil {
+				t.Fatal(err)
+			}
+			got := make([]byte, len(tt.wantReply))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != string(tt.wantReply) {
+				t.Errorf("got %v want %v", got, tt.wantReply)
+			}
+			if !tt.wantEcho {
+				return
+			}
+			if _, err := io.WriteString(conn, "hello\n"); err != nil {
+				t.Fatal(err)
+			}
+			l, err := bufio.NewReader(conn).ReadString('\n')
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := "hello\n"; l != want {
+				t.Errorf("got %q want %q", l, want)
+			}
+		})
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	// all CONNECT requests but the ones of BIND and authentication
+	if got, want := len(requests), 5; got != want {
+		t.Fatalf("got %v want %v", got, want)
+	}
+	if got, want := requests[0].Target, echo; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+	if got, want := requests[4].Version, 4; got != want {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
+
+func TestDynamicForwardShutdown(t *testing.T) {
+	srv := newTestServer(t, "server")
+	echo := newEchoServer(t, "tcp", "127.0.0.1:0")
+	client := newTestClient(t, srv)
+	f, err := DynamicForward(context.Background(), client, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.Dial("tcp", f.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	h, p, _ := net.SplitHostPort(echo)
+	port, _ := strconv.Atoi(p)
+	req := append(append([]byte{0x04, 0x01}, binary.BigEndian.AppendUint16(nil, uint16(port))...), net.ParseIP(h).To4()...)
+	if _, err := conn.Write(append(req, 0x00)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(conn, make([]byte, 8)); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- f.Shutdown(ctx)
+	}()
+	// the connection being forwarded still works until Shutdown gives up
+	if _, err := io.WriteString(conn, "hello\n"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bufio.NewReader(conn).ReadString('\n'); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != context.DeadlineExceeded {
+		t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+	}
+	if _, err := net.Dial("tcp", f.Addr().String()); err == nil {
+		t.Error("listener should be closed")
+	}
+}
+
+func TestUseForwardsDynamicForward(t *testing.T) {
+	srv := newTestServer(t, "server")
+	t.Setenv("HOME", t.TempDir())
+	sock := filepath.Join(shortTempDir(t), "socks.sock")
+	opts := append(srv.optionsWithKey(t, fmt.Sprintf("  DynamicForward %s\n", sock)), InsecureIgnoreHostKey(), UseForwards(true))
+	client, err := NewClient("server", opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Write([]byte{0x05, 0x01, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 2)
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatal(err)
+	}
+	if want := []byte{0x05, 0x00}; string(got) != string(want) {
+		t.Errorf("got %v want %v", got, want)
+	}
+}
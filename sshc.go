@@ -2,21 +2,20 @@
 package sshc
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"os"
-	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/ScaleFT/sshkeys"
-	"github.com/k1LoW/exec"
 	"golang.org/x/crypto/ssh"
 	"golang.org/x/crypto/ssh/agent"
-	"golang.org/x/crypto/ssh/knownhosts"
-	"golang.org/x/term"
 )
 
 type KeyAndPassphrase struct {
@@ -26,243 +25,503 @@ type KeyAndPassphrase struct {
 }
 
 type DialConfig struct {
-	Hostname          string
-	User              string
-	Port              int
-	UseAgent          bool
-	Knownhosts        []string
+	Hostname   string
+	User       string
+	Port       int
+	UseAgent   bool
+	Knownhosts []string
+	// GlobalKnownhosts are the known_hosts files read in addition to Knownhosts. New host keys are never added to them.
+	GlobalKnownhosts []string
+	// StrictHostKeyChecking is the policy for host key verification ( yes, no, ask or accept-new ).
+	// If it is empty, host keys are verified only when Knownhosts, GlobalKnownhosts or HostCertAuthorities is set.
+	StrictHostKeyChecking string
+	// InsecureIgnoreHostKey disables host key verification.
+	InsecureIgnoreHostKey bool
+	// HostCertAuthorities are the CA keys trusted to sign host certificates in addition to the @cert-authority lines of Knownhosts.
+	HostCertAuthorities []ssh.PublicKey
+	// HostKeyAlias is the name used instead of Hostname to look up and record the host key in Knownhosts.
+	HostKeyAlias string
+	// CheckHostIP also verifies the host key for the IP address of the host when it is dialed directly ( not through ProxyCommand, ProxyJump or DialTimeoutFunc ) and HostKeyAlias is not set.
+	CheckHostIP bool
+	// HostKeyAlgorithms are the host key algorithms to negotiate in order.
+	// If it is empty, the algorithms of the host keys recorded in Knownhosts for the host are preferred.
+	HostKeyAlgorithms []string
+	// Ciphers, MACs and KexAlgorithms are the algorithms to negotiate in order. If they are empty, the defaults of x/crypto/ssh are used.
+	Ciphers       []string
+	MACs          []string
+	KexAlgorithms []string
+	// HashKnownHosts hashes host names of the host keys added to the first file of Knownhosts.
+	HashKnownHosts    bool
 	KeyAndPassphrases []KeyAndPassphrase
-	ProxyCommand      string
-	ProxyJump         string
-	Password          string
-	Timeout           time.Duration
-	Wd                string
-	Auth              []ssh.AuthMethod
-	DialTimeoutFunc   func(network, addr string, timeout time.Duration) (net.Conn, error)
+	// Certificates are the OpenSSH certificates ( authorized_keys format ) of CertificateFile.
+	// Each certificate is offered together with the key of KeyAndPassphrases or ssh-agent that it certifies.
+	Certificates [][]byte
+	// IdentitiesOnly offers only the keys of KeyAndPassphrases and Certificates, even if ssh-agent has other keys.
+	IdentitiesOnly bool
+	ProxyCommand   string
+	// ProxyCommandTimeout is the timeout of the SSH key exchange through ProxyCommand. Authentication is not limited.
+	// If it is 0, Timeout is used, or 30 seconds if Timeout is also 0.
+	ProxyCommandTimeout time.Duration
+	// ProxyCommandStderr receives the standard error output of ProxyCommand. If it is nil, os.Stderr is used.
+	ProxyCommandStderr io.Writer
+	ProxyJump          string
+	Password           string
+	// Timeout is the timeout of the TCP dial and the SSH key exchange ( ConnectTimeout ).
+	// Authentication is not limited by Timeout so that prompts are not cut off.
+	Timeout time.Duration
+	// ConnectionAttempts is the number of tries of the TCP dial. If it is 0, 1 is used.
+	ConnectionAttempts int
+	Wd                 string
+	Auth               []ssh.AuthMethod
+	DialTimeoutFunc    func(network, addr string, timeout time.Duration) (net.Conn, error)
+	// Prompter asks for the passphrases of encrypted keys and confirms unknown host keys when StrictHostKeyChecking is ask.
+	// If it is nil, TerminalPrompter is used.
+	// If it is set, it is also asked for the password when Password is empty.
+	Prompter Prompter
+	// BatchMode disables all prompts ( NonInteractivePrompter is used regardless of Prompter ).
+	BatchMode bool
+	// KeyboardInteractive answers the challenges of keyboard-interactive authentication.
+	// If it is nil, keyboard-interactive authentication is not used.
+	KeyboardInteractive ssh.KeyboardInteractiveChallenge
+	// PreferredAuthentications is the authentication methods ( publickey, keyboard-interactive and password ) to offer in order.
+	// If it is nil, all of them are offered in the order above. Methods not in the list are not offered, except Auth that is always offered last.
+	PreferredAuthentications []string
+	// NumberOfPasswordPrompts is the number of tries of prompted passwords and keyboard-interactive authentication.
+	// If it is 0, 3 is used.
+	NumberOfPasswordPrompts int
+	// JumpHosts are the DialConfigs of the ProxyJump hosts in order.
+	// If JumpHosts is empty, ProxyJump is parsed and each jump host inherits the options of DialConfig.
+	JumpHosts []*DialConfig
 }
 
+const (
+	defaultProxyCommandTimeout     = 30 * time.Second
+	defaultNumberOfPasswordPrompts = 3
+	// connectionRetryInterval is the first interval between the tries of the TCP dial. It is doubled on each retry up to maxConnectionRetryInterval.
+	connectionRetryInterval    = time.Second
+	maxConnectionRetryInterval = 10 * time.Second
+)
+
+// Names of the authentication methods in PreferredAuthentications.
+const (
+	authPublickey           = "publickey"
+	authPassword            = "password"
+	authKeyboardInteractive = "keyboard-interactive"
+)
+
+// defaultPreferredAuthentications is the order of the authentication methods when DialConfig.PreferredAuthentications is nil.
+var defaultPreferredAuthentications = []string{authPublickey, authKeyboardInteractive, authPassword}
+
 // NewClient reads ssh_config(5) ( Default is ~/.ssh/config and /etc/ssh/ssh_config ) and returns *ssh.Client.
 func NewClient(host string, options ...Option) (*ssh.Client, error) {
+	return NewClientContext(context.Background(), host, options...)
+}
+
+// NewClientContext is like NewClient but uses ctx while establishing the connection.
+// Once the *ssh.Client is returned, ctx no longer affects it.
+func NewClientContext(ctx context.Context, host string, options ...Option) (*ssh.Client, error) {
 	c, err := NewConfig(options...)
 	if err != nil {
 		return nil, err
 	}
-	pc, wd := c.getProxyCommand(host)
-	if wd == "" {
-		wd, err = os.Getwd()
-		if err != nil {
-			return nil, err
-		}
-	}
-	dc := &DialConfig{
-		User:            c.getUser(host),
-		ProxyCommand:    pc,
-		ProxyJump:       c.Get(host, "ProxyJump"),
-		Knownhosts:      c.knownhosts,
-		UseAgent:        c.useAgent,
-		Password:        c.password,
-		Wd:              wd,
-		Auth:            c.auth,
-		DialTimeoutFunc: c.dialTimeoutFunc,
-	}
-	hostname, err := c.getHostname(host)
+	r, err := c.Resolve(host)
 	if err != nil {
 		return nil, err
 	}
-	dc.Hostname = hostname
-	port, err := c.getPort(host)
+	dc, err := c.DialConfig(r)
 	if err != nil {
 		return nil, err
 	}
-	dc.Port = port
-	keys, err := c.getKeyAndPassphrases(host)
+
+	client, err := DialContext(ctx, dc)
 	if err != nil {
 		return nil, err
 	}
-	dc.KeyAndPassphrases = keys
-
-	return Dial(dc)
+	if c.useForwards {
+		if err := startForwards(client, r); err != nil {
+			_ = client.Close()
+			return nil, err
+		}
+	}
+	return client, nil
 }
 
 // Dial returns *ssh.Client using Config.
 func Dial(dc *DialConfig) (*ssh.Client, error) {
-	addr := fmt.Sprintf("%s:%d", dc.Hostname, dc.Port)
-	var (
-		signers []ssh.Signer
-		err     error
-	)
-	auth := []ssh.AuthMethod{}
-	for _, k := range dc.KeyAndPassphrases {
-		signer, err := sshkeys.ParseEncryptedPrivateKey(k.key, k.passphrase)
-		if err != nil {
-			// passphrase
-			fmt.Print("Enter passphrase for key: ")
-			passPhrase, err := term.ReadPassword(0)
+	return DialContext(context.Background(), dc)
+}
+
+// DialContext returns *ssh.Client using Config.
+// Cancellation and deadline of ctx are honored through TCP dial, ProxyCommand startup, SSH handshake and ssh-agent queries.
+// Once the *ssh.Client is returned, ctx no longer affects it.
+func DialContext(ctx context.Context, dc *DialConfig) (*ssh.Client, error) {
+	return dialContext(ctx, dc, nil)
+}
+
+// dialContext returns *ssh.Client using Config.
+// If via is not nil, the connection is tunneled through via instead of ProxyCommand, ProxyJump or TCP dial.
+func dialContext(ctx context.Context, dc *DialConfig, via *ssh.Client) (_ *ssh.Client, err error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	addr := net.JoinHostPort(dc.Hostname, strconv.Itoa(dc.Port))
+	var signers, pubkeys []ssh.Signer
+	preferred := dc.preferredAuthentications()
+	methods := map[string][]ssh.AuthMethod{}
+	prompter := dc.prompter()
+
+	// publickey
+	if slices.Contains(preferred, authPublickey) {
+		var skipped error
+		signers, skipped = dc.signers(prompter)
+		defer func() {
+			// tell why the keys were not used
+			var authErr *AuthFailedError
+			if errors.As(err, &authErr) {
+				if keyErr := errors.Join(skipped, lazySignerErrors(signers)); keyErr != nil {
+					authErr.Err = errors.Join(authErr.Err, keyErr)
+				}
+			}
+		}()
+		var agentSigners []ssh.Signer
+		if dc.UseAgent && sshAuthSockExists() {
+			conn, err := dialSSHAgent(ctx)
 			if err != nil {
-				fmt.Println("")
 				return nil, err
 			}
-			signer, err = sshkeys.ParseEncryptedPrivateKey(k.key, passPhrase)
+			defer conn.Close()
+			stop := context.AfterFunc(ctx, func() {
+				_ = conn.Close()
+			})
+			defer stop()
+			agentSigners, err = agent.NewClient(conn).Signers()
 			if err != nil {
-				fmt.Println("")
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
 				return nil, err
 			}
-			fmt.Println("")
 		}
-		signers = append(signers, signer)
-	}
-	useAgent := false
-	if dc.UseAgent && sshAuthSockExists() {
-		sshAgentClient, err := newSSHAgentClient()
+		certs, err := dc.certificates()
 		if err != nil {
 			return nil, err
 		}
-		identities, err := sshAgentClient.List()
+		var identities []ssh.PublicKey
+		if dc.IdentitiesOnly {
+			identities = dc.identities(signers, certs)
+		}
+		pubkeys, err = withCertificates(publicKeySigners(agentSigners, signers, dc.IdentitiesOnly, identities), certs)
 		if err != nil {
 			return nil, err
 		}
-		if len(identities) > 0 {
-			auth = append(auth, ssh.PublicKeysCallback(sshAgentClient.Signers))
-			useAgent = true
+		if len(pubkeys) > 0 {
+			methods[authPublickey] = append(methods[authPublickey], ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+				// keys that failed to load in the previous handshake are not offered again
+				return withoutFailedKeys(pubkeys, signers), nil
+			}))
 		}
 	}
-	if len(signers) > 0 && !useAgent {
-		auth = append(auth, ssh.PublicKeys(signers...))
-	}
 
 	// password
 	if dc.Password != "" {
-		auth = append(auth, ssh.Password(dc.Password))
+		methods[authPassword] = append(methods[authPassword], ssh.Password(dc.Password))
+	} else if dc.Prompter != nil && !dc.BatchMode {
+		methods[authPassword] = append(methods[authPassword], ssh.RetryableAuthMethod(ssh.PasswordCallback(func() (string, error) {
+			return prompter.PasswordPrompt(dc.User, dc.Hostname)
+		}), dc.numberOfPasswordPrompts()))
+	}
+
+	// keyboard-interactive
+	if dc.KeyboardInteractive != nil {
+		methods[authKeyboardInteractive] = append(methods[authKeyboardInteractive], ssh.RetryableAuthMethod(dc.KeyboardInteractive, dc.numberOfPasswordPrompts()))
+	}
+
+	auth := []ssh.AuthMethod{}
+	for _, m := range preferred {
+		auth = append(auth, methods[m]...)
 	}
 
 	// additional ssh.AuthMethod
 	auth = append(auth, dc.Auth...)
 
-	cb, err := hostKeyCallback(dc.Knownhosts)
-	if err != nil {
-		return nil, err
+	proxyCommand := dc.ProxyCommand
+	if strings.EqualFold(proxyCommand, "none") {
+		proxyCommand = ""
+	}
+	var jumpHosts []*DialConfig
+	if via == nil && proxyCommand == "" {
+		jumpHosts = dc.JumpHosts
+		if len(jumpHosts) == 0 && dc.ProxyJump != "" {
+			jumpHosts, err = dc.jumpHosts()
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	sshConfig := &ssh.ClientConfig{
-		User:            dc.User,
-		Auth:            auth,
-		HostKeyCallback: cb,
-		Timeout:         dc.Timeout,
+	// The IP address of the host is known only when it is dialed directly
+	direct := via == nil && proxyCommand == "" && len(jumpHosts) == 0 && dc.DialTimeoutFunc == nil
+	cb, err := hostKeyCallback(dc, direct)
+	if err != nil {
+		return nil, err
 	}
 
-	proxyCommand := dc.ProxyCommand
-	if proxyCommand == "" && dc.ProxyJump != "" {
-		parsedProxyJump, err := parseProxyJump(dc.ProxyJump)
+	hostKeyAlgorithms := dc.HostKeyAlgorithms
+	if len(hostKeyAlgorithms) == 0 && !dc.InsecureIgnoreHostKey {
+		hostKeyAlgorithms, err = orderHostKeyAlgorithms(existingFiles(dc.knownhostsFiles()), dc.hostKeyHostname(addr))
 		if err != nil {
 			return nil, err
 		}
-		proxyCommand = expandVerbs(parsedProxyJump, dc.User, dc.Port, dc.Hostname)
 	}
 
-	if proxyCommand != "" {
-		client, server := net.Pipe()
-		unescapedProxyCommand := expandVerbs(proxyCommand, dc.User, dc.Port, dc.Hostname)
-		cmd := exec.Command("sh", "-c", unescapedProxyCommand) // #nosec
-		cmd.Dir = dc.Wd
-		cmd.Stdin = server
-		cmd.Stdout = server
-		cmd.Stderr = os.Stderr
-
-		if err := cmd.Start(); err != nil {
-			return nil, fmt.Errorf("proxy command:%s error:%w", unescapedProxyCommand, err)
-		}
+	sshConfig := &ssh.ClientConfig{
+		Config: ssh.Config{
+			Ciphers:      dc.Ciphers,
+			MACs:         dc.MACs,
+			KeyExchanges: dc.KexAlgorithms,
+		},
+		User:              dc.User,
+		Auth:              auth,
+		HostKeyCallback:   cb,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           dc.Timeout,
+	}
 
-		done := make(chan *ssh.Client)
-		errchan := make(chan error)
-		go func() {
-			conn, incomingChannels, incomingRequests, err := ssh.NewClientConn(client, addr, sshConfig)
+	connect := func() (*ssh.Client, error) {
+		if via != nil {
+			conn, err := via.DialContext(ctx, "tcp", addr)
 			if err != nil {
-				errchan <- err
-				return
+				return nil, err
 			}
-			done <- ssh.NewClient(conn, incomingChannels, incomingRequests)
-		}()
+			return newClientConn(ctx, conn, addr, sshConfig)
+		}
+
+		if len(jumpHosts) > 0 {
+			return dialViaJumpHosts(ctx, jumpHosts, addr, sshConfig)
+		}
 
-		for {
-			select {
-			case err := <-errchan:
+		if proxyCommand != "" {
+			t := &tokens{host: dc.Hostname, hostname: dc.Hostname, user: dc.User, port: dc.Port}
+			unescapedProxyCommand, err := t.expand(proxyCommand, proxyTokens, false)
+			if err != nil {
 				return nil, err
-			case <-time.After(30 * time.Second):
-				if err := exec.KillCommand(cmd); err != nil {
+			}
+			pc, err := startProxyCommand(unescapedProxyCommand, dc.Wd, dc.proxyCommandStderr())
+			if err != nil {
+				return nil, err
+			}
+			timeout := dc.proxyCommandTimeout()
+			pctx, cancel := context.WithCancel(ctx)
+			defer cancel()
+			var timedOut atomic.Bool
+			timer := time.AfterFunc(timeout, func() {
+				timedOut.Store(true)
+				cancel()
+			})
+			defer timer.Stop()
+			// The timeout is for the key exchange, which ends with the host key verification. Authentication is not limited
+			config := *sshConfig
+			config.Timeout = 0
+			config.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+				timer.Stop()
+				return sshConfig.HostKeyCallback(hostname, remote, key)
+			}
+			client, err := newClientConn(pctx, pc, addr, &config)
+			if err != nil {
+				// newClientConn has already closed pc
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				if timedOut.Load() {
+					return nil, pc.error(fmt.Errorf("proxy command timeout(%v)", timeout))
+				}
+				var (
+					authErr *AuthFailedError
+					keyErr  *HostKeyMismatchError
+				)
+				if errors.As(err, &authErr) || errors.As(err, &keyErr) {
 					return nil, err
 				}
-				return nil, fmt.Errorf("proxy command timeout(30sec)")
-			case client := <-done:
-				return client, nil
+				return nil, pc.error(err)
 			}
+			return client, nil
 		}
 
+		conn, err := dc.dial(ctx, addr)
+		if err != nil {
+			return nil, err
+		}
+		return newClientConn(ctx, conn, addr, sshConfig)
+	}
+	for {
+		failed := failedKeys(signers)
+		client, err := connect()
+		if err != nil && ctx.Err() == nil && hasKeysAfterFailure(pubkeys, signers, failed) {
+			// x/crypto/ssh gives up publickey authentication when a key fails to sign ( e.g. the passphrase is not given ).
+			// Retry without the key so that the following keys are tried, as OpenSSH skips the key
+			continue
+		}
+		return client, err
 	}
+}
+
+// dial connects to addr over TCP, trying ConnectionAttempts times with backoff.
+func (dc *DialConfig) dial(ctx context.Context, addr string) (net.Conn, error) {
 	network := "tcp"
-	if dc.DialTimeoutFunc == nil {
-		return ssh.Dial(network, addr, sshConfig)
+	interval := connectionRetryInterval
+	for attempt := 1; ; attempt++ {
+		var (
+			conn net.Conn
+			err  error
+		)
+		if dc.DialTimeoutFunc == nil {
+			d := &net.Dialer{Timeout: dc.Timeout}
+			conn, err = d.DialContext(ctx, network, addr)
+		} else {
+			// expand ssh.Dial with DialTimeoutFunc
+			conn, err = dc.DialTimeoutFunc(network, addr, timeoutWithDeadline(ctx, dc.Timeout))
+		}
+		if err == nil {
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if attempt >= dc.connectionAttempts() {
+			if attempt > 1 {
+				return nil, fmt.Errorf("%d connection attempts failed: %w", attempt, err)
+			}
+			return nil, err
+		}
+		t := time.NewTimer(interval)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return nil, ctx.Err()
+		case <-t.C:
+		}
+		interval = min(interval*2, maxConnectionRetryInterval)
 	}
-	// expand ssh.Dial with DialTimeoutFunc
-	conn, err := dc.DialTimeoutFunc(network, addr, sshConfig.Timeout)
-	if err != nil {
-		return nil, err
+}
+
+// prompter returns the Prompter used for dc.
+func (dc *DialConfig) prompter() Prompter {
+	if dc.BatchMode {
+		return NonInteractivePrompter{}
 	}
-	c, chans, reqs, err := ssh.NewClientConn(conn, addr, sshConfig)
-	if err != nil {
-		return nil, err
+	if dc.Prompter != nil {
+		return dc.Prompter
 	}
-	return ssh.NewClient(c, chans, reqs), nil
+	return TerminalPrompter{}
 }
 
-func newSSHAgentClient() (agent.ExtendedAgent, error) {
-	socket := os.Getenv("SSH_AUTH_SOCK")
-	conn, err := net.Dial("unix", socket)
-	if err != nil {
-		return nil, err
+func (dc *DialConfig) preferredAuthentications() []string {
+	if dc.PreferredAuthentications == nil {
+		return defaultPreferredAuthentications
 	}
+	return dc.PreferredAuthentications
+}
 
-	return agent.NewClient(conn), nil
+func (dc *DialConfig) proxyCommandTimeout() time.Duration {
+	switch {
+	case dc.ProxyCommandTimeout > 0:
+		return dc.ProxyCommandTimeout
+	case dc.Timeout > 0:
+		return dc.Timeout
+	}
+	return defaultProxyCommandTimeout
 }
 
-func sshAuthSockExists() bool {
-	return os.Getenv("SSH_AUTH_SOCK") != ""
+func (dc *DialConfig) proxyCommandStderr() io.Writer {
+	if dc.ProxyCommandStderr == nil {
+		return os.Stderr
+	}
+	return dc.ProxyCommandStderr
 }
 
-func parseProxyJump(text string) (string, error) {
-	proxyPort := "22"
-	if strings.Contains(text, ":") {
-		var portReg = regexp.MustCompile(`.+:(?P<port>[0-9]+)`)
-		match := portReg.FindAllStringSubmatch(text, -1)
-		if len(match) == 0 {
-			return "", errors.New("proxyJump is wrong format")
-		}
+func (dc *DialConfig) connectionAttempts() int {
+	if dc.ConnectionAttempts <= 0 {
+		return 1
+	}
+	return dc.ConnectionAttempts
+}
 
-		for i, name := range portReg.SubexpNames() {
-			if i != 0 && name == "port" {
-				proxyPort = match[0][i]
+func (dc *DialConfig) numberOfPasswordPrompts() int {
+	if dc.NumberOfPasswordPrompts <= 0 {
+		return defaultNumberOfPasswordPrompts
+	}
+	return dc.NumberOfPasswordPrompts
+}
+
+// newClientConn performs the SSH handshake over conn.
+// If ctx is done before the handshake completes, conn is closed and ctx.Err() is returned.
+// If config.Timeout is set, the key exchange must complete within it.
+// If conn does not support deadlines ( e.g. a channel of a jump host ), conn is closed when the timeout expires.
+func newClientConn(ctx context.Context, conn net.Conn, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var timedOut atomic.Bool
+	if config.Timeout > 0 {
+		endKex := func() {
+			_ = conn.SetDeadline(time.Time{})
+		}
+		if err := conn.SetDeadline(time.Now().Add(config.Timeout)); err != nil {
+			timer := time.AfterFunc(config.Timeout, func() {
+				timedOut.Store(true)
+				_ = conn.Close()
+			})
+			defer timer.Stop()
+			endKex = func() {
+				timer.Stop()
 			}
 		}
-		text = text[:strings.Index(text, ":")]
+		// The host key is verified at the end of the key exchange. Authentication after it is not limited
+		verify := config.HostKeyCallback
+		c := *config
+		c.HostKeyCallback = func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			endKex()
+			return verify(hostname, remote, key)
+		}
+		config = &c
+	}
+	stop := context.AfterFunc(ctx, func() {
+		_ = conn.Close()
+	})
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if !stop() {
+		// ctx is done and conn is already closed
+		if err == nil {
+			_ = c.Close()
+		}
+		return nil, ctx.Err()
 	}
-	return fmt.Sprintf("ssh -l %%r -W %%h:%%p  %s -p %s", text, proxyPort), nil
+	if err != nil {
+		_ = conn.Close()
+		if timedOut.Load() {
+			return nil, fmt.Errorf("ssh: handshake failed: key exchange timeout(%v): %w", config.Timeout, os.ErrDeadlineExceeded)
+		}
+		return nil, handshakeError(err, config.User, addr)
+	}
+	return ssh.NewClient(c, chans, reqs), nil
 }
 
-func expandVerbs(v, user string, port int, hostname string) string {
-	v = strings.ReplaceAll(v, "%h", hostname)
-	v = strings.ReplaceAll(v, "%p", strconv.Itoa(port))
-	v = strings.ReplaceAll(v, "%r", user)
-	return v
+// timeoutWithDeadline returns the shorter of timeout and the time remaining until the deadline of ctx.
+func timeoutWithDeadline(ctx context.Context, timeout time.Duration) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return timeout
+	}
+	remain := time.Until(deadline)
+	if timeout == 0 || remain < timeout {
+		return remain
+	}
+	return timeout
 }
 
-func hostKeyCallback(files []string) (ssh.HostKeyCallback, error) {
-	if len(files) > 0 {
-		hostKeyCallback, err := knownhosts.New(files...)
-		if err != nil {
-			return nil, err
-		}
-		return hostKeyCallback, nil
-	}
-	return func(hostname string, remote net.Addr, key ssh.PublicKey) error {
-		return nil
-	}, nil
+func dialSSHAgent(ctx context.Context) (net.Conn, error) {
+	socket := os.Getenv("SSH_AUTH_SOCK")
+	d := &net.Dialer{}
+	return d.DialContext(ctx, "unix", socket)
+}
+
+func sshAuthSockExists() bool {
+	return os.Getenv("SSH_AUTH_SOCK") != ""
 }
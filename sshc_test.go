@@ -1,9 +1,19 @@
 package sshc
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
 	"os"
 	"path/filepath"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
 )
 
 func TestUser(t *testing.T) {
@@ -228,60 +238,385 @@ func TestGet(t *testing.T) {
 	}
 }
 
-func TestConfig_parseProxyJump(t *testing.T) {
+func TestDialContext(t *testing.T) {
+	t.Run("canceled before dial", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		_, err := DialContext(ctx, &DialConfig{Hostname: "127.0.0.1", Port: 22})
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("got %v want %v", err, context.Canceled)
+		}
+	})
+
+	t.Run("deadline exceeded during handshake", func(t *testing.T) {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() {
+			_ = ln.Close()
+		})
+		go func() {
+			// accept but never speak SSH
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				t.Cleanup(func() {
+					_ = conn.Close()
+				})
+			}
+		}()
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		addr := ln.Addr().(*net.TCPAddr)
+		_, err = DialContext(ctx, &DialConfig{Hostname: addr.IP.String(), Port: addr.Port})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+		}
+	})
+
+	t.Run("deadline exceeded during ProxyCommand", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		_, err := DialContext(ctx, &DialConfig{
+			Hostname:     "127.0.0.1",
+			Port:         22,
+			ProxyCommand: "sleep 10",
+		})
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("got %v want %v", err, context.DeadlineExceeded)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("DialContext did not return promptly: %v", elapsed)
+		}
+	})
+}
+
+func testHome(t *testing.T, path string) string {
+	t.Helper()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := filepath.Abs(filepath.Join(wd, "testdata", path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dir
+}
+
+// newSilentServer starts a server that accepts connections but never speaks SSH, and returns its address.
+func newSilentServer(t *testing.T) *net.TCPAddr {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() {
+				_ = conn.Close()
+			})
+		}
+	}()
+	return ln.Addr().(*net.TCPAddr)
+}
+
+func TestConnectTimeout(t *testing.T) {
+	addr := newSilentServer(t)
+	t.Setenv("HOME", t.TempDir())
+	data := fmt.Sprintf("Host server\n  HostName %s\n  Port %d\n  ConnectTimeout 10\n", addr.IP, addr.Port)
+	start := time.Now()
+	_, err := NewClient("server", ClearConfig(), ConfigData([]byte(data)), UseAgent(false), ConnectTimeout(100*time.Millisecond))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("got %v want %v", err, os.ErrDeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("NewClient did not return promptly: %v", elapsed)
+	}
+}
+
+func TestConnectTimeoutSucceeds(t *testing.T) {
+	srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+		c.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"OTP: "}, []bool{true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) == 1 && answers[0] == "123456" {
+				return nil, nil
+			}
+			return nil, errTestUnauthorized
+		}
+	}))
+	key, err := filepath.Abs("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// slow answers longer than ConnectTimeout
+	slow := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+		time.Sleep(500 * time.Millisecond)
+		return []string{"123456"}, nil
+	}
+	tests := []struct {
+		name   string
+		config string
+		opts   []Option
+	}{
+		{"ConnectTimeout of ssh_config", fmt.Sprintf("  IdentityFile %s\n  ConnectTimeout 5\n", key), nil},
+		{"ConnectTimeout option", fmt.Sprintf("  IdentityFile %s\n", key), []Option{ConnectTimeout(5 * time.Second)}},
+		{"authentication is not limited", "  IdentityFile none\n", []Option{ConnectTimeout(200 * time.Millisecond), KeyboardInteractive(slow)}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			opts := append(srv.options(tt.config), InsecureIgnoreHostKey())
+			opts = append(opts, tt.opts...)
+			client, err := NewClient("server", opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_ = client.Close()
+		})
+	}
+}
+
+func TestConnectionAttempts(t *testing.T) {
+	srv := newTestServer(t, "server")
+	tests := []struct {
+		name     string
+		config   string
+		opts     []Option
+		failures int
+		want     int
+		wantErr  bool
+	}{
+		{"default", "", nil, 1, 1, true},
+		{"ConnectionAttempts", "  ConnectionAttempts 2\n", nil, 1, 2, false},
+		{"ConnectionAttempts exhausted", "  ConnectionAttempts 2\n", nil, 2, 2, true},
+		{"option overrides ssh_config", "  ConnectionAttempts 1\n", []Option{ConnectionAttempts(2)}, 1, 2, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			t.Setenv("HOME", t.TempDir())
+			got := 0
+			dial := DialTimeoutFunc(func(network, addr string, timeout time.Duration) (net.Conn, error) {
+				got++
+				if got <= tt.failures {
+					return nil, errors.New("connection refused")
+				}
+				return net.DialTimeout(network, addr, timeout)
+			})
+			opts := append(srv.optionsWithKey(t, tt.config), InsecureIgnoreHostKey(), dial)
+			opts = append(opts, tt.opts...)
+			client, err := NewClient("server", opts...)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if client != nil {
+				_ = client.Close()
+			}
+			if got != tt.want {
+				t.Errorf("got %d attempts want %d", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("invalid ConnectionAttempts", func(t *testing.T) {
+		c, err := NewConfig(ClearConfig(), ConfigData([]byte("Host server\n  ConnectionAttempts 0\n")))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := c.Resolve("server"); err == nil {
+			t.Error("want error")
+		}
+	})
+}
+
+func TestKeyboardInteractive(t *testing.T) {
+	srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+		c.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+			answers, err := challenge("", "", []string{"Password: ", "OTP: "}, []bool{false, true})
+			if err != nil {
+				return nil, err
+			}
+			if len(answers) == 2 && answers[0] == "pass" && answers[1] == "123456" {
+				return nil, nil
+			}
+			return nil, errTestUnauthorized
+		}
+	}))
+
+	// wrongOnce answers wrong at the first challenge.
+	wrongOnce := func() ssh.KeyboardInteractiveChallenge {
+		called := 0
+		return func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			called++
+			if called == 1 {
+				return []string{"wrong", "wrong"}, nil
+			}
+			return []string{"pass", "123456"}, nil
+		}
+	}
+
 	tests := []struct {
 		name    string
-		text    string
-		want    string
+		config  string
+		opts    []Option
 		wantErr bool
 	}{
-		{
-			name:    "full config",
-			text:    "user@host:2002",
-			want:    "ssh -l %r -W %h:%p  user@host -p 2002",
-			wantErr: false,
-		},
-		{
-			name:    "not defined port",
-			text:    "user@host",
-			want:    "ssh -l %r -W %h:%p  user@host -p 22",
-			wantErr: false,
-		},
-		{
-			name:    "not defined user",
-			text:    "host:2222",
-			want:    "ssh -l %r -W %h:%p  host -p 2222",
-			wantErr: false,
-		},
-		{
-			name:    "wrong port format",
-			text:    "user@host:xxxxx",
-			wantErr: true,
-		},
+		{"static answers", "", []Option{KeyboardInteractiveAnswers("pass", "123456")}, false},
+		{"wrong static answers", "", []Option{KeyboardInteractiveAnswers("pass", "000000")}, true},
+		{"too few static answers", "", []Option{KeyboardInteractiveAnswers("pass")}, true},
+		{"callback retried", "", []Option{KeyboardInteractive(wrongOnce())}, false},
+		{"callback not retried", "  NumberOfPasswordPrompts 1\n", []Option{KeyboardInteractive(wrongOnce())}, true},
+		{"prompter", "", []Option{UsePrompter(&kbdPrompter{answers: []string{"pass", "123456"}})}, false},
+		{"prompter in batch mode", "  BatchMode yes\n", []Option{UsePrompter(&kbdPrompter{answers: []string{"pass", "123456"}})}, true},
+		{"disabled", "  KbdInteractiveAuthentication no\n", []Option{KeyboardInteractiveAnswers("pass", "123456")}, true},
 	}
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := parseProxyJump(tt.text)
+			t.Setenv("HOME", t.TempDir())
+			opts := append(srv.options("  User alice\n"+tt.config), InsecureIgnoreHostKey())
+			opts = append(opts, tt.opts...)
+			client, err := NewClient("server", opts...)
 			if (err != nil) != tt.wantErr {
-				t.Errorf("Config.parseProxyJump() error = %v, wantErr %v", err, tt.wantErr)
-				return
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
 			}
-			if got != tt.want {
-				t.Errorf("Config.parseProxyJump() = %v, want %v", got, tt.want)
+			if client != nil {
+				_ = client.Close()
 			}
 		})
 	}
+
+	t.Run("terminal by default", func(t *testing.T) {
+		orig := ttyName
+		ttyName = filepath.Join(t.TempDir(), "tty")
+		t.Cleanup(func() {
+			ttyName = orig
+		})
+		t.Setenv("HOME", t.TempDir())
+		_, err := NewClient("server", append(srv.options("  User alice\n"), InsecureIgnoreHostKey())...)
+		if !errors.Is(err, ErrNoTerminal) {
+			t.Errorf("got %v want %v", err, ErrNoTerminal)
+		}
+	})
 }
 
-func testHome(t *testing.T, path string) string {
-	t.Helper()
-	wd, err := os.Getwd()
-	if err != nil {
-		t.Fatal(err)
+type kbdPrompter struct {
+	NonInteractivePrompter
+	answers []string
+}
+
+func (p *kbdPrompter) KeyboardInteractive(name, instruction string, questions []string, echos []bool) ([]string, error) {
+	if len(questions) != len(p.answers) {
+		return nil, errors.New("unexpected questions")
 	}
-	dir, err := filepath.Abs(filepath.Join(wd, "testdata", path))
+	return p.answers, nil
+}
+
+func TestProxyCommand(t *testing.T) {
+	t.Run("ProxyCommandTimeout", func(t *testing.T) {
+		start := time.Now()
+		_, err := Dial(&DialConfig{
+			Hostname:            "127.0.0.1",
+			Port:                22,
+			ProxyCommand:        "sleep 10",
+			ProxyCommandTimeout: 100 * time.Millisecond,
+		})
+		var perr *ProxyCommandError
+		if !errors.As(err, &perr) {
+			t.Fatalf("got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("Dial did not return promptly: %v", elapsed)
+		}
+	})
+
+	t.Run("ConnectTimeout is used for ProxyCommand", func(t *testing.T) {
+		t.Setenv("HOME", t.TempDir())
+		start := time.Now()
+		_, err := NewClient("server", ClearConfig(), ConfigData([]byte("Host server\n  ProxyCommand sleep 10\n  ConnectTimeout 1\n")), UseAgent(false))
+		var perr *ProxyCommandError
+		if !errors.As(err, &perr) {
+			t.Fatalf("got %v", err)
+		}
+		if elapsed := time.Since(start); elapsed > 5*time.Second {
+			t.Errorf("NewClient did not return promptly: %v", elapsed)
+		}
+	})
+
+	t.Run("ProxyCommandStderr", func(t *testing.T) {
+		t.Setenv("HOME", t.TempDir())
+		buf := &bytes.Buffer{}
+		_, err := NewClient("server", ClearConfig(), ConfigData([]byte("Host server\n  ProxyCommand echo oops >&2; exit 3\n")), UseAgent(false), ProxyCommandStderr(buf))
+		if err == nil {
+			t.Fatal("want error")
+		}
+		if got, want := strings.TrimSpace(buf.String()), "oops"; got != want {
+			t.Errorf("got %v want %v", got, want)
+		}
+	})
+
+	t.Run("authentication is not limited by ProxyCommandTimeout", func(t *testing.T) {
+		srv := newTestServer(t, "server", withServerConfig(func(c *ssh.ServerConfig) {
+			c.KeyboardInteractiveCallback = func(conn ssh.ConnMetadata, challenge ssh.KeyboardInteractiveChallenge) (*ssh.Permissions, error) {
+				if _, err := challenge("", "", []string{"OTP: "}, []bool{true}); err != nil {
+					return nil, err
+				}
+				return nil, nil
+			}
+		}))
+		t.Setenv("HOME", t.TempDir())
+		data := fmt.Sprintf("Host server\n  ProxyCommand SSHC_TEST_PROXY_ADDR=%s '%s' -test.run='^TestProxyCommandHelper$'\n  IdentityFile none\n", srv.addr, os.Args[0])
+		slow := func(name, instruction string, questions []string, echos []bool) ([]string, error) {
+			time.Sleep(500 * time.Millisecond)
+			return []string{"123456"}, nil
+		}
+		client, err := NewClient("server", ClearConfig(), ConfigData([]byte(data)), UseAgent(false), InsecureIgnoreHostKey(), ProxyCommandTimeout(200*time.Millisecond), KeyboardInteractive(slow))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = client.Close()
+	})
+
+	t.Run("Close kills ProxyCommand", func(t *testing.T) {
+		pc, err := startProxyCommand("sleep 10", "", io.Discard)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := pc.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if pc.cmd.ProcessState == nil {
+			t.Error("ProxyCommand should be waited for")
+		}
+	})
+}
+
+// TestProxyCommandHelper is not a test but the ProxyCommand that connects stdin and stdout to SSHC_TEST_PROXY_ADDR.
+func TestProxyCommandHelper(t *testing.T) {
+	addr := os.Getenv("SSHC_TEST_PROXY_ADDR")
+	if addr == "" {
+		t.Skip("only for ProxyCommand")
+	}
+	conn, err := net.Dial("tcp", addr)
 	if err != nil {
-		t.Fatal(err)
+		os.Exit(1)
 	}
-	return dir
+	go func() {
+		_, _ = io.Copy(conn, os.Stdin)
+	}()
+	_, _ = io.Copy(os.Stdout, conn)
+	os.Exit(0)
 }
@@ -0,0 +1,335 @@
+package sshc
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// testServer is an in-process SSH server for testing.
+// It accepts the public key of testdata/id_rsa, answers `hostname` with its name and supports direct-tcpip and direct-streamlocal channels and tcpip-forward requests.
+type testServer struct {
+	name    string
+	addr    string
+	host    string
+	port    int
+	hostKey ssh.Signer
+	config  *ssh.ServerConfig
+
+	directTCPIP atomic.Int64
+	maxSessions int64
+	mu          sync.Mutex
+	users       []string
+}
+
+type testServerOption func(*testServer)
+
+func withServerConfig(fn func(*ssh.ServerConfig)) testServerOption {
+	return func(s *testServer) {
+		fn(s.config)
+	}
+}
+
+// withMaxSessions limits the number of sessions per connection like MaxSessions of sshd.
+func withMaxSessions(n int64) testServerOption {
+	return func(s *testServer) {
+		s.maxSessions = n
+	}
+}
+
+func newTestServer(t *testing.T, name string, opts ...testServerOption) *testServer {
+	t.Helper()
+	_, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostKey, err := ssh.NewSignerFromKey(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile("testdata/id_rsa.pub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	authorized, _, _, _, err := ssh.ParseAuthorizedKey(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testServer{
+		name:    name,
+		hostKey: hostKey,
+	}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, errTestUnauthorized
+		},
+	}
+	s.config.AddHostKey(hostKey)
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = ln.Close()
+	})
+	s.addr = ln.Addr().String()
+	s.host = "127.0.0.1"
+	s.port = ln.Addr().(*net.TCPAddr).Port
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(t, conn)
+		}
+	}()
+	return s
+}
+
+// options returns Options that connect to s as host `server` ( or `alias` ) without the files of the user and the agent.
+// config is appended to the Host block.
+func (s *testServer) options(config string) []Option {
+	data := fmt.Sprintf("Host server alias\n  HostName %s\n  Port %d\n", s.host, s.port) + config
+	return []Option{ClearConfig(), ConfigData([]byte(data)), UseAgent(false)}
+}
+
+// optionsWithKey returns the options of s that authenticate with testdata/id_rsa.
+func (s *testServer) optionsWithKey(t *testing.T, config string) []Option {
+	t.Helper()
+	key, err := filepath.Abs("testdata/id_rsa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s.options(fmt.Sprintf("  IdentityFile %s\n", key) + config)
+}
+
+func (s *testServer) serve(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	sc, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	t.Cleanup(func() {
+		_ = sc.Close()
+	})
+	s.mu.Lock()
+	s.users = append(s.users, sc.User())
+	s.mu.Unlock()
+	go s.handleGlobalRequests(sc, reqs)
+	var sessions atomic.Int64
+	for nc := range chans {
+		switch nc.ChannelType() {
+		case "session":
+			if s.maxSessions > 0 && sessions.Load() >= s.maxSessions {
+				_ = nc.Reject(ssh.Prohibited, "too many sessions")
+				continue
+			}
+			ch, reqs, err := nc.Accept()
+			if err != nil {
+				continue
+			}
+			sessions.Add(1)
+			go func() {
+				defer sessions.Add(-1)
+				s.handleSession(ch, reqs)
+			}()
+		case "direct-tcpip":
+			s.directTCPIP.Add(1)
+			go s.handleDirectTCPIP(nc)
+		case "direct-streamlocal@openssh.com":
+			go s.handleDirectStreamLocal(nc)
+		default:
+			_ = nc.Reject(ssh.UnknownChannelType, "unsupported channel type")
+		}
+	}
+}
+
+func (s *testServer) handleSession(ch ssh.Channel, reqs <-chan *ssh.Request) {
+	defer ch.Close()
+	for req := range reqs {
+		if req.Type != "exec" {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		_ = req.Reply(true, nil)
+		cmd := string(req.Payload[4:])
+		status := uint32(0)
+		if cmd == "hostname" {
+			_, _ = io.WriteString(ch, s.name+"\n")
+		} else {
+			status = 127
+		}
+		_, _ = ch.SendRequest("exit-status", false, binary.BigEndian.AppendUint32(nil, status))
+		return
+	}
+}
+
+// handleGlobalRequests handles tcpip-forward and cancel-tcpip-forward requests by listening on the host of the test server.
+func (s *testServer) handleGlobalRequests(sc *ssh.ServerConn, reqs <-chan *ssh.Request) {
+	listeners := map[string]net.Listener{}
+	defer func() {
+		for _, ln := range listeners {
+			_ = ln.Close()
+		}
+	}()
+	for req := range reqs {
+		var payload struct {
+			Addr string
+			Port uint32
+		}
+		if (req.Type != "tcpip-forward" && req.Type != "cancel-tcpip-forward") || ssh.Unmarshal(req.Payload, &payload) != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		key := net.JoinHostPort(payload.Addr, strconv.Itoa(int(payload.Port)))
+		if req.Type == "cancel-tcpip-forward" {
+			if ln, ok := listeners[key]; ok {
+				_ = ln.Close()
+				delete(listeners, key)
+			}
+			_ = req.Reply(true, nil)
+			continue
+		}
+		ln, err := net.Listen("tcp", key)
+		if err != nil {
+			_ = req.Reply(false, nil)
+			continue
+		}
+		port := uint32(ln.Addr().(*net.TCPAddr).Port)
+		if payload.Port == 0 {
+			key = net.JoinHostPort(payload.Addr, strconv.Itoa(int(port)))
+		}
+		listeners[key] = ln
+		_ = req.Reply(true, binary.BigEndian.AppendUint32(nil, port))
+		go func() {
+			for {
+				conn, err := ln.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					origin := conn.RemoteAddr().(*net.TCPAddr)
+					ch, reqs, err := sc.OpenChannel("forwarded-tcpip", ssh.Marshal(&struct {
+						Addr       string
+						Port       uint32
+						OriginAddr string
+						OriginPort uint32
+					}{payload.Addr, port, origin.IP.String(), uint32(origin.Port)}))
+					if err != nil {
+						_ = conn.Close()
+						return
+					}
+					go ssh.DiscardRequests(reqs)
+					pipe(ch, conn)
+				}()
+			}
+		}()
+	}
+}
+
+func (s *testServer) handleDirectTCPIP(nc ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, conn)
+}
+
+func (s *testServer) handleDirectStreamLocal(nc ssh.NewChannel) {
+	var payload struct {
+		SocketPath string
+		Reserved0  string
+		Reserved1  uint32
+	}
+	if err := ssh.Unmarshal(nc.ExtraData(), &payload); err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	conn, err := net.Dial("unix", payload.SocketPath)
+	if err != nil {
+		_ = nc.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	ch, reqs, err := nc.Accept()
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+	pipe(ch, conn)
+}
+
+// pipe copies data between ch and conn until either side is closed.
+func pipe(ch ssh.Channel, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(ch, conn)
+		_ = ch.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		_, _ = io.Copy(conn, ch)
+		if c, ok := conn.(interface{ CloseWrite() error }); ok {
+			_ = c.CloseWrite()
+		}
+	}()
+	wg.Wait()
+	_ = ch.Close()
+	_ = conn.Close()
+}
+
+var errTestUnauthorized = errors.New("unauthorized")
+
+// runHostname runs `hostname` on client and returns the output.
+func runHostname(t *testing.T, client *ssh.Client) string {
+	t.Helper()
+	session, err := client.NewSession()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer session.Close()
+	out, err := session.Output("hostname")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(out)
+}
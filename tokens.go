@@ -0,0 +1,124 @@
+package sshc
+
+import (
+	"crypto/sha1" // #nosec G505
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Tokens accepted by each keyword of ssh_config(5).
+const (
+	// hostnameTokens are the tokens of Hostname.
+	hostnameTokens = "h"
+	// proxyTokens are the tokens of ProxyCommand and ProxyJump.
+	proxyTokens = "hnpr"
+	// fileTokens are the tokens of CertificateFile, ControlPath, IdentityAgent, IdentityFile, LocalForward, Match exec, RemoteForward and UserKnownHostsFile.
+	fileTokens = "CdhijkLlnpru"
+)
+
+// tokens are the values of the tokens ( %h, %p, ... ) of ssh_config(5).
+type tokens struct {
+	// host is the host name given to Resolve ( %n ).
+	host         string
+	hostname     string
+	user         string
+	port         int
+	proxyJump    string
+	hostKeyAlias string
+}
+
+// expand expands the tokens in allowed ( e.g. "hpr" ) and %% in v.
+// If env is true, environment variables ( ${NAME} ) are also expanded.
+// An unknown token, a token not in allowed or an unset environment variable is an error.
+func (t *tokens) expand(v, allowed string, env bool) (string, error) {
+	var b strings.Builder
+	for i := 0; i < len(v); i++ {
+		switch {
+		case v[i] == '%':
+			i++
+			if i >= len(v) {
+				return "", fmt.Errorf("invalid token at the end of %q", v)
+			}
+			if v[i] == '%' {
+				b.WriteByte('%')
+				continue
+			}
+			if !strings.ContainsRune(allowed, rune(v[i])) {
+				return "", fmt.Errorf("unknown token %%%c in %q", v[i], v)
+			}
+			s, err := t.value(v[i])
+			if err != nil {
+				return "", err
+			}
+			b.WriteString(s)
+		case env && strings.HasPrefix(v[i:], "${"):
+			end := strings.IndexByte(v[i:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated environment variable in %q", v)
+			}
+			name := v[i+2 : i+end]
+			s, ok := os.LookupEnv(name)
+			if !ok {
+				return "", fmt.Errorf("environment variable ${%s} in %q is not set", name, v)
+			}
+			b.WriteString(s)
+			i += end
+		default:
+			b.WriteByte(v[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// value returns the value of the token c.
+func (t *tokens) value(c byte) (string, error) {
+	switch c {
+	case 'h':
+		return t.hostname, nil
+	case 'n':
+		return t.host, nil
+	case 'p':
+		return strconv.Itoa(t.port), nil
+	case 'r':
+		return t.user, nil
+	case 'j':
+		return t.proxyJump, nil
+	case 'k':
+		if t.hostKeyAlias != "" {
+			return t.hostKeyAlias, nil
+		}
+		return t.host, nil
+	case 'u':
+		return localUsername(), nil
+	case 'i':
+		return strconv.Itoa(os.Getuid()), nil
+	case 'd':
+		return os.UserHomeDir()
+	case 'l':
+		return os.Hostname()
+	case 'L':
+		h, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		h, _, _ = strings.Cut(h, ".")
+		return h, nil
+	case 'C':
+		l, err := os.Hostname()
+		if err != nil {
+			return "", err
+		}
+		// same as OpenSSH, the hash of %l%h%p%r%j
+		sum := sha1.Sum([]byte(l + t.hostname + strconv.Itoa(t.port) + t.user + t.proxyJump)) // #nosec G401
+		return hex.EncodeToString(sum[:]), nil
+	}
+	return "", fmt.Errorf("unknown token %%%c", c)
+}
+
+// escapeTokens escapes '%' in v so that expanding it again returns v.
+func escapeTokens(v string) string {
+	return strings.ReplaceAll(v, "%", "%%")
+}
@@ -0,0 +1,67 @@
+package sshc
+
+import (
+	"os"
+	"strconv"
+	"testing"
+)
+
+func TestExpandTokens(t *testing.T) {
+	t.Setenv("HOME", "/home/testuser")
+	t.Setenv("SSHC_TEST", "value")
+	tk := &tokens{
+		host:      "myhost",
+		hostname:  "203.0.113.1",
+		user:      "k1low",
+		port:      10022,
+		proxyJump: "bastion",
+	}
+	tests := []struct {
+		in      string
+		allowed string
+		env     bool
+		want    string
+		wantErr bool
+	}{
+		{"%h:%p", proxyTokens, false, "203.0.113.1:10022", false},
+		{"%r@%n", proxyTokens, false, "k1low@myhost", false},
+		{"100%%", proxyTokens, false, "100%", false},
+		{"%%h", proxyTokens, false, "%h", false},
+		{"%d/.ssh/%k", fileTokens, false, "/home/testuser/.ssh/myhost", false},
+		{"%i", fileTokens, false, strconv.Itoa(os.Getuid()), false},
+		{"%j", fileTokens, false, "bastion", false},
+		{"${SSHC_TEST}/%h", fileTokens, true, "value/203.0.113.1", false},
+		{"${SSHC_TEST}", fileTokens, false, "${SSHC_TEST}", false},
+		{"${SSHC_TEST_UNSET}", fileTokens, true, "", true},
+		{"${SSHC_TEST", fileTokens, true, "", true},
+		{"%d", proxyTokens, false, "", true},
+		{"%x", fileTokens, false, "", true},
+		{"%", fileTokens, false, "", true},
+		{"%h.%p", hostnameTokens, false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := tk.expand(tt.in, tt.allowed, tt.env)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("got %v want %v", got, tt.want)
+			}
+		})
+	}
+
+	t.Run("%C", func(t *testing.T) {
+		got, err := tk.expand("%C", fileTokens, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) != 40 {
+			t.Errorf("got %v", got)
+		}
+		other := &tokens{hostname: "203.0.113.2", user: "k1low", port: 10022}
+		if o, _ := other.expand("%C", fileTokens, false); o == got {
+			t.Error("%C should differ between hosts")
+		}
+	})
+}
@@ -0,0 +1,6 @@
+//go:build !windows
+
+package sshc
+
+// ttyName is the name of the controlling terminal.
+var ttyName = "/dev/tty"